@@ -0,0 +1,62 @@
+package timerstore
+
+import (
+	"time"
+)
+
+type actionKind int
+
+const (
+	actionDelete actionKind = iota
+	actionReschedule
+	actionReplace
+	actionKeep
+)
+
+// Action ActionHandler返回的处理动作, 由Delete, RescheduleAfter, ReplaceValue, Keep生成
+type Action struct {
+	kind  actionKind
+	value string
+	after time.Duration
+}
+
+// ActionHandler 返回处理动作的回调函数, 通过WithActionHandler设置
+// 回调执行期间key被其他调用修改或删除时, 不再执行返回的动作
+type ActionHandler func(key string, value string) Action
+
+// Delete 删除key, 周期key不再触发, 与Handler的默认行为相同
+func Delete() Action {
+	return Action{kind: actionDelete}
+}
+
+// RescheduleAfter 保留value, 在d之后再次触发, 周期key随后按原规则继续
+func RescheduleAfter(d time.Duration) Action {
+	return Action{kind: actionReschedule, after: d}
+}
+
+// ReplaceValue 写入新的value, 按一次性key在d之后触发
+func ReplaceValue(value string, d time.Duration) Action {
+	return Action{kind: actionReplace, value: value, after: d}
+}
+
+// Keep 保留key, 一次性key不再定时但仍可通过Get读取, 周期key按原规则继续
+func Keep() Action {
+	return Action{kind: actionKeep}
+}
+
+// ops 返回动作在Ack时对key执行的操作, 为空时按默认处理: 一次性key删除, 周期key按规则重新定时
+func (a Action) ops(ev Event) []TxnOp {
+	switch a.kind {
+	case actionDelete:
+		return []TxnOp{{Type: TxnDel, Key: ev.Key}}
+	case actionReschedule:
+		return []TxnOp{{Type: TxnExpire, Key: ev.Key, TTL: a.after}}
+	case actionReplace:
+		return []TxnOp{{Type: TxnSet, Key: ev.Key, Value: a.value, TTL: a.after}}
+	case actionKeep:
+		if ev.Spec == "" {
+			return []TxnOp{{Type: TxnPersist, Key: ev.Key}}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package timerstore
+
+import (
+	"time"
+)
+
+// DeadLetter 重试用完仍失败的回调, 启用WithDeadLetter后保存在provider中, 同一个key只保留最近一次
+type DeadLetter struct {
+	Key      string
+	Value    string
+	Deadline time.Time // 最后一次计划的触发时间
+	FailedAt time.Time // 最后一次失败的时间
+	Attempts int       // 执行回调的总次数
+	Err      string    // 最后一次的错误信息
+	Spec     string    // 周期定时规则, 一次性key为空
+}
+
+// DeadLetters 列出所有死信, 按key排序
+func (t *TimerStore) DeadLetters() ([]DeadLetter, error) {
+	if t.isClosed() {
+		return nil, errClosed
+	}
+	return t.store.DeadLetters()
+}
+
+// ReplayDeadLetter 将死信重新写入为ttl之后到期的key并移除死信, ok表示是否重新写入
+// 周期key保留其定时规则, 重放的触发完成后按规则继续
+// 死信不存在或同名key已存在(如周期key仍在运行)时不做处理
+func (t *TimerStore) ReplayDeadLetter(key string, ttl time.Duration) (bool, error) {
+	if t.isClosed() {
+		return false, errClosed
+	}
+	deadline := t.clock.Now().Add(ttl)
+	ok, err := t.store.ReplayDeadLetter(key, deadline)
+	if err != nil || !ok {
+		return ok, err
+	}
+	t.notify(deadline)
+	return true, nil
+}
+
+// PurgeDeadLetters 删除指定key的死信, 不指定key时删除全部, 返回删除的个数
+func (t *TimerStore) PurgeDeadLetters(keys ...string) (int, error) {
+	if t.isClosed() {
+		return 0, errClosed
+	}
+	return t.store.PurgeDeadLetters(keys)
+}
+
+// bury 重试用完后保存死信, 未启用WithDeadLetter时不做处理
+func (t *TimerStore) bury(ev Event, cause error) error {
+	if !t.deadLetter {
+		return nil
+	}
+	return t.store.AddDeadLetter(DeadLetter{
+		Key:      ev.Key,
+		Value:    ev.Value,
+		Deadline: ev.Deadline,
+		FailedAt: t.clock.Now(),
+		Attempts: ev.Attempt,
+		Err:      cause.Error(),
+		Spec:     ev.Spec,
+	})
+}
@@ -15,6 +15,16 @@ func (t *TimerError) Error() string {
 }
 
 var (
-	errDuplicate      = &TimerError{2, "duplicate registered"}
-	errUnkownProvider = &TimerError{2, "provider is unknown"}
+	errDuplicate       = &TimerError{2, "duplicate registered"}
+	errUnkownProvider  = &TimerError{2, "provider is unknown"}
+	errClosed          = &TimerError{3, "store is closed"}
+	errRunning         = &TimerError{4, "store is already running"}
+	errVersionMismatch = &TimerError{5, "version mismatch"}
+	errNotInteger      = &TimerError{6, "value is not an integer"}
+	errInvalidSpec     = &TimerError{7, "invalid schedule spec"}
 )
+
+// invalidSpec 返回带有spec内容的errInvalidSpec
+func invalidSpec(spec string) error {
+	return &TimerError{errInvalidSpec.Code, errInvalidSpec.Msg + ": " + spec}
+}
@@ -0,0 +1,72 @@
+package timerstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Event 执行回调时传入的事件
+type Event struct {
+	ID       string // 租约id, 由Provider.Claim生成, 用于Ack/Nack
+	Key      string
+	Value    string
+	Deadline time.Time // 计划的触发时间, 读取次数用完时为零值
+	FiredAt  time.Time // 实际执行回调的时间
+	Attempt  int       // 第几次执行回调, 从1开始
+	Store    string    // 所属TimerStore的prefix
+	Reason   Reason    // 触发原因
+	Spec     string    // 周期定时规则, 一次性key为空
+}
+
+// EventHandler 以Event为参数的回调函数, 通过WithEventHandler设置
+// ctx为Run的ctx, 读取次数用完时为context.Background(), 返回的error交给ErrorHandler处理
+type EventHandler func(ctx context.Context, ev Event) error
+
+// EventHandler 将Handler适配为EventHandler, h为nil时不执行任何操作
+func (h Handler) EventHandler() EventHandler {
+	if h == nil {
+		return func(ctx context.Context, ev Event) error { return nil }
+	}
+	return func(ctx context.Context, ev Event) error {
+		h(ev.Key, ev.Value)
+		return nil
+	}
+}
+
+// EventHandler 将ReasonHandler适配为EventHandler, h为nil时不执行任何操作
+func (h ReasonHandler) EventHandler() EventHandler {
+	if h == nil {
+		return func(ctx context.Context, ev Event) error { return nil }
+	}
+	return func(ctx context.Context, ev Event) error {
+		h(ev.Key, ev.Value, ev.Reason)
+		return nil
+	}
+}
+
+// newLeaseID 生成key的租约id, 格式为 随机串:key
+func newLeaseID(key string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b) + ":" + key
+}
+
+// leaseKey 从租约id中取出key
+func leaseKey(id string) string {
+	return id[strings.Index(id, ":")+1:]
+}
+
+// leased 根据被租用的entry生成Event
+func leased(key string, ent entry) Event {
+	return Event{
+		ID:       ent.Lease,
+		Key:      key,
+		Value:    ent.Value,
+		Deadline: fromUnixMilli(ent.Due),
+		Attempt:  ent.Attempt,
+		Spec:     ent.Spec,
+	}
+}
@@ -1,29 +1,59 @@
 package timerstore
 
 import (
+	"container/heap"
 	"container/list"
-	"fmt"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type entry struct {
-	TimerKey string
-	Value    string
+	TimerKey  string
+	Value     string
+	Deadline  int64  // 过期时间, unix毫秒, 为0表示没有过期时间
+	Paused    bool   // 是否被暂停
+	Remaining int64  // 暂停时记录的剩余时间, 毫秒
+	Version   uint64 // 版本号, 每次写入value时取store内递增的新值
+	TTL       int64  // 最近一次定时的时长, 毫秒, 滑动过期时按此重新定时
+	Sliding   bool   // 是否在读取时重新定时
+	Reads     int64  // 剩余读取次数, 为0表示不限制
+	Spec      string // 周期定时规则, 为空表示只触发一次
+	Attempt   int    // 已被租用的次数, 租约过期或Nack后再次租用时累加
+	Lease     string // 当前租约id, 为空表示未被租用
+	Due       int64  // 租用期间记录的原计划触发时间, unix毫秒
+}
+
+// newEntry 生成在deadline过期的entry, TTL为deadline距now的时长
+func newEntry(val string, deadline time.Time, now time.Time) entry {
+	due := unixMilli(deadline)
+	return entry{
+		Value:    val,
+		Deadline: due,
+		TTL:      remaining(due, now),
+	}
 }
 
 type memProvider struct {
-	prefix string
-	timer  map[string]*list.List
-	cache  map[string]entry
-	mutex  sync.RWMutex
+	prefix  string
+	timer   map[int64]*list.List // 过期时间(unix毫秒) => 在此时间过期的所有key
+	queue   *deadlineHeap        // timer中所有的过期时间, 堆顶为最早的过期时间
+	cache   map[string]entry
+	dead    map[string]DeadLetter // 死信, 与cache相互独立
+	clock   Clock                 // 计算过期时间使用的时钟
+	version uint64                // 最近分配的版本号, key被删除后也不会重复使用
+	mutex   sync.RWMutex
 }
 
 // NewMemProvider 对外提供的创建方法
 func NewMemProvider() *memProvider {
 	return &memProvider{
-		timer: make(map[string]*list.List),
+		timer: make(map[int64]*list.List),
+		queue: &deadlineHeap{index: make(map[int64]int)},
 		cache: make(map[string]entry),
+		dead:  make(map[string]DeadLetter),
+		clock: sysClock{},
 	}
 }
 
@@ -31,6 +61,10 @@ func (m *memProvider) SetPrefix(prefix string) {
 	m.prefix = prefix
 }
 
+func (m *memProvider) SetClock(clock Clock) {
+	m.clock = clock
+}
+
 func (m *memProvider) Get(key string) (string, bool, error) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
@@ -44,41 +78,264 @@ func (m *memProvider) Get(key string) (string, bool, error) {
 	return entry.Value, ok, nil
 }
 
+func (m *memProvider) Deadline(key string) (time.Time, bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	item, ok := m.cache[key]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	if item.Lease != "" {
+		return fromUnixMilli(item.Due), true, nil
+	}
+	if item.Deadline == 0 {
+		return time.Time{}, true, nil
+	}
+	return fromUnixMilli(item.Deadline), true, nil
+}
+
 func (m *memProvider) Set(key string, val string, ttl int64) error {
+	return m.SetWithTTL(key, val, time.Duration(ttl)*time.Second)
+}
+
+func (m *memProvider) SetWithTTL(key string, val string, ttl time.Duration) error {
+	return m.SetAt(key, val, m.clock.Now().Add(ttl))
+}
+
+func (m *memProvider) SetAt(key string, val string, deadline time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.set(key, newEntry(val, deadline, m.clock.Now()))
+
+	return nil
+}
+
+func (m *memProvider) SetSliding(key string, val string, ttl time.Duration) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	now := m.clock.Now()
+	item := newEntry(val, now.Add(ttl), now)
+	item.Sliding = true
+	m.set(key, item)
+
+	return nil
+}
+
+func (m *memProvider) SetMaxReads(key string, val string, ttl time.Duration, reads int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.clock.Now()
+	item := newEntry(val, now.Add(ttl), now)
+	item.Reads = reads
+	m.set(key, item)
+
+	return nil
+}
+
+func (m *memProvider) SetRecurring(key string, val string, spec string) (time.Time, error) {
+	sched, err := ParseSchedule(spec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := m.clock.Now()
+	first := sched.Next(now)
+	if first.IsZero() {
+		return time.Time{}, invalidSpec(spec)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	item := newEntry(val, first, now)
+	item.Spec = spec
+	m.set(key, item)
+
+	return first, nil
+}
+
+func (m *memProvider) Touch(key string, always bool) (string, uint64, bool, bool, error) {
+	m.mutex.RLock()
 	item, ok := m.cache[key]
+	m.mutex.RUnlock()
+
+	if !ok {
+		return "", 0, false, false, nil
+	}
+	if item.Reads == 0 && !slides(item, always) {
+		return item.Value, item.Version, true, false, nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// 加写锁前key可能已被修改, 重新读取
+	item, ok, exhausted := m.touch(key, always)
+	return item.Value, item.Version, ok, exhausted, nil
+}
+
+// touch 读取entry, 扣减读取次数, 用完时删除key, 滑动过期的key重新定时, 调用方需持有写锁
+func (m *memProvider) touch(key string, always bool) (entry, bool, bool) {
+	item, ok := m.cache[key]
+	if !ok {
+		return item, false, false
+	}
+	if item.Reads == 1 {
+		m.unlink(key, item)
+		delete(m.cache, key)
+		return item, true, true
+	}
+	if item.Reads > 1 {
+		item.Reads--
+		m.cache[key] = item
+	}
+	if slides(item, always) {
+		m.expire(key, item, m.clock.Now().Add(time.Duration(item.TTL)*time.Millisecond))
+	}
+
+	return item, true, false
+}
+
+func (m *memProvider) SetNX(key string, val string, ttl time.Duration) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.cache[key]; ok {
+		return false, nil
+	}
+	now := m.clock.Now()
+	m.set(key, newEntry(val, now.Add(ttl), now))
+
+	return true, nil
+}
+
+func (m *memProvider) SetXX(key string, val string, ttl time.Duration) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.cache[key]; !ok {
+		return false, nil
+	}
+	now := m.clock.Now()
+	m.set(key, newEntry(val, now.Add(ttl), now))
+
+	return true, nil
+}
+
+func (m *memProvider) CompareAndSet(key string, val string, ttl time.Duration, version uint64) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.cache[key].Version != version {
+		return false, nil
+	}
+	now := m.clock.Now()
+	m.set(key, newEntry(val, now.Add(ttl), now))
+
+	return true, nil
+}
+
+// set 以item替换key原有的entry并定时, 分配新的版本号, 调用方需持有写锁
+func (m *memProvider) set(key string, item entry) {
+	old, ok := m.cache[key]
 	if ok {
 		// 已存在, 去除原定时器
-		l, _ := m.timer[item.TimerKey]
-		if l != nil {
-			for e := l.Front(); e != nil; e = e.Next() {
-				if e.Value.(string) == key {
-					l.Remove(e)
-					break
-				}
-			}
-			if l.Len() == 0 {
-				delete(m.timer, item.TimerKey)
-			}
-		}
+		m.unlink(key, old)
 	}
-	timeKey := m.genTimerKey(time.Now().Unix() + ttl)
-	l, _ := m.timer[timeKey]
-	if l == nil {
-		l = list.New()
+
+	m.version++
+	item.Version = m.version
+	m.link(key, item)
+	m.cache[key] = item
+}
+
+func (m *memProvider) Expire(key string, ttl time.Duration) (bool, error) {
+	return m.ExpireAt(key, m.clock.Now().Add(ttl))
+}
+
+func (m *memProvider) ExpireAt(key string, deadline time.Time) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	item, ok := m.cache[key]
+	if !ok {
+		return false, nil
 	}
-	l.PushFront(key)
-	m.timer[timeKey] = l
 
-	item = entry{
-		TimerKey: timeKey,
-		Value:    val,
+	m.expire(key, release(item), deadline)
+
+	return true, nil
+}
+
+func (m *memProvider) Persist(key string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	item, ok := m.cache[key]
+	if !ok {
+		return false, nil
 	}
+
+	m.unlink(key, item)
+	item = release(item)
+	item.Deadline = 0
+	item.Paused = false
+	item.Remaining = 0
 	m.cache[key] = item
 
-	return nil
+	return true, nil
+}
+
+func (m *memProvider) Pause(key string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	item, ok := m.cache[key]
+	if !ok {
+		return false, nil
+	}
+	if item.Paused || item.Deadline == 0 {
+		return true, nil
+	}
+
+	// 回调执行中的key按原计划的触发时间计算剩余时间, 不把租约过期时间当作定时
+	deadline := item.Deadline
+	if item.Lease != "" {
+		deadline = item.Due
+	}
+	m.unlink(key, item)
+	item = release(item)
+	item.Remaining = remaining(deadline, m.clock.Now())
+	item.Deadline = 0
+	item.Paused = true
+	m.cache[key] = item
+
+	return true, nil
+}
+
+func (m *memProvider) Resume(key string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	item, ok := m.cache[key]
+	if !ok {
+		return false, nil
+	}
+	if !item.Paused {
+		return true, nil
+	}
+
+	item.Deadline = unixMilli(m.clock.Now()) + item.Remaining
+	item.Paused = false
+	item.Remaining = 0
+	m.link(key, item)
+	m.cache[key] = item
+
+	return true, nil
 }
 
 func (m *memProvider) Del(key string) error {
@@ -87,54 +344,398 @@ func (m *memProvider) Del(key string) error {
 
 	item, ok := m.cache[key]
 	if ok {
-		l, _ := m.timer[item.TimerKey]
-		if l != nil {
-			for e := l.Front(); e != nil; e = e.Next() {
-				if e.Value.(string) == key {
-					l.Remove(e)
-					break
-				}
+		m.unlink(key, item)
+		delete(m.cache, key)
+	}
+
+	return nil
+}
+
+func (m *memProvider) Take(key string) (string, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	item, ok := m.cache[key]
+	if !ok || firing(item, m.clock.Now()) {
+		return "", false, nil
+	}
+	m.unlink(key, item)
+	delete(m.cache, key)
+
+	return item.Value, true, nil
+}
+
+func (m *memProvider) Claim(now time.Time, limit int, visibility time.Duration) ([]Event, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// 从堆顶依次取出到期的定时器, 租用的key移到租约过期时间, 定时器清空后离开堆
+	cutoff := unixMilli(now)
+	expiry := cutoff + visibility.Nanoseconds()/int64(time.Millisecond)
+	var claimed []Event
+	for len(claimed) < limit && m.queue.Len() > 0 {
+		deadline := m.queue.items[0]
+		if deadline > cutoff || deadline >= expiry {
+			break
+		}
+		var keys []string
+		for e := m.timer[deadline].Front(); e != nil && len(claimed)+len(keys) < limit; e = e.Next() {
+			keys = append(keys, e.Value.(string))
+		}
+		for _, key := range keys {
+			item, ok := m.cache[key]
+			if !ok || item.Deadline != deadline {
+				// 残留的定时, 清除后继续
+				m.unlink(key, entry{Deadline: deadline})
+				continue
 			}
-			if l.Len() == 0 {
-				delete(m.timer, item.TimerKey)
+			if item.Due == 0 {
+				item.Due = item.Deadline
 			}
+			item.Attempt++
+			item.Lease = newLeaseID(key)
+			m.rearm(key, item, expiry)
+			claimed = append(claimed, leased(key, item))
 		}
+	}
 
-		delete(m.cache, key)
+	return claimed, nil
+}
+
+func (m *memProvider) Ack(id string, ops []TxnOp) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := leaseKey(id)
+	item, ok := m.cache[key]
+	if !ok || item.Lease != id {
+		return false, nil
+	}
+
+	now := m.clock.Now()
+	if len(ops) > 0 {
+		m.cache[key] = release(item)
+		for _, op := range ops {
+			m.exec(key, op, now)
+		}
+		return true, nil
 	}
 
+	if item.Spec != "" {
+		next, err := nextFire(item.Spec, item.Due, now)
+		if err != nil {
+			return false, err
+		}
+		if next != 0 {
+			m.expire(key, release(item), fromUnixMilli(next))
+			return true, nil
+		}
+	}
+	m.unlink(key, item)
+	delete(m.cache, key)
+
+	return true, nil
+}
+
+func (m *memProvider) Nack(id string, deadline time.Time) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := leaseKey(id)
+	item, ok := m.cache[key]
+	if !ok || item.Lease != id {
+		return false, nil
+	}
+	item.Lease = ""
+	m.rearm(key, item, unixMilli(deadline))
+
+	return true, nil
+}
+
+func (m *memProvider) AddDeadLetter(dl DeadLetter) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.dead[dl.Key] = dl
+
 	return nil
 }
 
-func (m *memProvider) Before(t int64) (map[string]string, bool, error) {
+func (m *memProvider) DeadLetters() ([]DeadLetter, error) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
-	due := make(map[string]string)
+	letters := make([]DeadLetter, 0, len(m.dead))
+	for _, dl := range m.dead {
+		letters = append(letters, dl)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].Key < letters[j].Key
+	})
+
+	return letters, nil
+}
 
-	timerKey := m.genTimerKey(t)
+func (m *memProvider) ReplayDeadLetter(key string, deadline time.Time) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	for tKey, l := range m.timer {
-		if tKey <= timerKey {
-			if l != nil {
-				for e := l.Front(); e != nil; e = e.Next() {
-					k := e.Value.(string)
-					if item, ok := m.cache[k]; ok {
-						due[k] = item.Value
-					}
-				}
-			}
+	dl, ok := m.dead[key]
+	if !ok {
+		return false, nil
+	}
+	if _, ok := m.cache[key]; ok {
+		return false, nil
+	}
+	item := newEntry(dl.Value, deadline, m.clock.Now())
+	item.Spec = dl.Spec
+	m.set(key, item)
+	delete(m.dead, key)
+
+	return true, nil
+}
+
+func (m *memProvider) PurgeDeadLetters(keys []string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(keys) == 0 {
+		n := len(m.dead)
+		m.dead = make(map[string]DeadLetter)
+		return n, nil
+	}
+
+	n := 0
+	for _, key := range keys {
+		if _, ok := m.dead[key]; ok {
+			delete(m.dead, key)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// GetMany 与Touch相同地扣减读取次数和重新定时
+func (m *memProvider) GetMany(keys []string, always bool) []GetResult {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	results := make([]GetResult, len(keys))
+	for i, key := range keys {
+		if item, ok, exhausted := m.touch(key, always); ok {
+			results[i].Value = item.Value
+			results[i].OK = true
+			results[i].Exhausted = exhausted
 		}
 	}
 
-	has := true
-	if len(due) == 0 {
-		has = false
+	return results
+}
+
+func (m *memProvider) SetMany(items []Item) []error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.clock.Now()
+	for _, item := range items {
+		m.set(item.Key, newEntry(item.Value, now.Add(item.TTL), now))
 	}
 
-	return due, has, nil
+	return make([]error, len(items))
+}
+
+func (m *memProvider) DelMany(keys []string) []error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, key := range keys {
+		if item, ok := m.cache[key]; ok {
+			m.unlink(key, item)
+			delete(m.cache, key)
+		}
+	}
+
+	return make([]error, len(keys))
+}
+
+func (m *memProvider) Commit(conds []TxnCond, ops []TxnOp) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, cond := range conds {
+		if m.cache[cond.Key].Version != cond.Version {
+			return false, nil
+		}
+	}
+
+	now := m.clock.Now()
+	for _, op := range ops {
+		m.exec(op.Key, op, now)
+	}
+
+	return true, nil
+}
+
+// exec 对key执行事务中的一个操作, 调用方需持有写锁
+func (m *memProvider) exec(key string, op TxnOp, now time.Time) {
+	item, ok := m.cache[key]
+	switch op.Type {
+	case TxnSet:
+		m.set(key, newEntry(op.Value, now.Add(op.TTL), now))
+	case TxnDel:
+		if ok {
+			m.unlink(key, item)
+			delete(m.cache, key)
+		}
+	case TxnExpire:
+		if ok {
+			m.expire(key, release(item), now.Add(op.TTL))
+		}
+	case TxnPersist:
+		if ok {
+			m.unlink(key, item)
+			item = release(item)
+			item.Deadline = 0
+			item.Paused = false
+			item.Remaining = 0
+			m.cache[key] = item
+		}
+	}
+}
+
+func (m *memProvider) IncrBy(key string, delta int64, ttlIfNew time.Duration) (int64, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// 回调执行中的key的计数窗口已结束, 按不存在处理并开始新的窗口, 回调拿到的是结束时的计数
+	now := m.clock.Now()
+	item, ok := m.cache[key]
+	if !ok || firing(item, now) {
+		m.set(key, newEntry(strconv.FormatInt(delta, 10), now.Add(ttlIfNew), now))
+		return delta, true, nil
+	}
+
+	n, err := strconv.ParseInt(item.Value, 10, 64)
+	if err != nil {
+		return 0, false, errNotInteger
+	}
+	n += delta
+	item = release(item)
+	item.Value = strconv.FormatInt(n, 10)
+	m.version++
+	item.Version = m.version
+	m.cache[key] = item
+
+	return n, false, nil
+}
+
+func (m *memProvider) Next() (time.Time, bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.queue.Len() == 0 {
+		return time.Time{}, false, nil
+	}
+	return fromUnixMilli(m.queue.items[0]), true, nil
+}
+
+// expire 修改已存在key的过期时间, 调用方需持有写锁
+func (m *memProvider) expire(key string, item entry, deadline time.Time) {
+	item.TTL = remaining(unixMilli(deadline), m.clock.Now())
+	m.rearm(key, item, unixMilli(deadline))
+}
+
+// rearm 以deadline(unix毫秒)重新定时, 不修改TTL, 调用方需持有写锁
+func (m *memProvider) rearm(key string, item entry, deadline int64) {
+	m.unlink(key, item)
+	item.Deadline = deadline
+	item.Paused = false
+	item.Remaining = 0
+	m.link(key, item)
+	m.cache[key] = item
+}
+
+// slides 判断读取时是否需要按原始ttl重新定时, 没有过期时间, 被暂停或回调执行中的key不重新定时
+func slides(item entry, always bool) bool {
+	return (always || item.Sliding) && item.Deadline != 0 && item.TTL > 0 && item.Lease == ""
+}
+
+// release 作废key的租约, 回调执行期间key被修改时调用, 之后的Ack不再影响key
+func release(item entry) entry {
+	item.Lease = ""
+	item.Due = 0
+	item.Attempt = 0
+	return item
+}
+
+// firing 判断key的回调是否正在执行, 租约过期后视为未执行
+func firing(item entry, now time.Time) bool {
+	return item.Lease != "" && item.Deadline > unixMilli(now)
+}
+
+// link 将key加入其过期时间对应的定时器列表, 调用方需持有写锁
+func (m *memProvider) link(key string, item entry) {
+	l, _ := m.timer[item.Deadline]
+	if l == nil {
+		l = list.New()
+		m.timer[item.Deadline] = l
+		heap.Push(m.queue, item.Deadline)
+	}
+	l.PushFront(key)
+}
+
+// unlink 将key从其过期时间对应的定时器列表中去除, 调用方需持有写锁
+func (m *memProvider) unlink(key string, item entry) {
+	if item.Deadline == 0 {
+		return
+	}
+	l, _ := m.timer[item.Deadline]
+	if l == nil {
+		return
+	}
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e.Value.(string) == key {
+			l.Remove(e)
+			break
+		}
+	}
+	if l.Len() == 0 {
+		delete(m.timer, item.Deadline)
+		heap.Remove(m.queue, m.queue.index[item.Deadline])
+	}
+}
+
+// deadlineHeap 过期时间的最小堆, index记录每个过期时间在items中的位置, 用于定时器清空时移除
+type deadlineHeap struct {
+	items []int64
+	index map[int64]int
+}
+
+func (h *deadlineHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *deadlineHeap) Less(i, j int) bool {
+	return h.items[i] < h.items[j]
+}
+
+func (h *deadlineHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i]] = i
+	h.index[h.items[j]] = j
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	deadline := x.(int64)
+	h.index[deadline] = len(h.items)
+	h.items = append(h.items, deadline)
 }
 
-func (m *memProvider) genTimerKey(ttl int64) string {
-	return fmt.Sprintf("%s:%d", m.prefix, ttl)
+func (h *deadlineHeap) Pop() interface{} {
+	n := len(h.items) - 1
+	deadline := h.items[n]
+	h.items = h.items[:n]
+	delete(h.index, deadline)
+	return deadline
 }
@@ -1,8 +1,11 @@
 package timerstore
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -32,8 +35,8 @@ func TestMemProvider(t *testing.T) {
 
 	mem.Set("second", ("this is the second"), 10)
 
-	due, ok, _ := mem.Before(time.Now().Unix() + 15)
-	equal(true, ok)
+	due, err := mem.Claim(time.Now().Add(15*time.Second), 10, time.Minute)
+	equal(nil, err)
 	equal(2, len(due))
 	t.Logf("due: %v\n", due)
 
@@ -90,38 +93,1525 @@ func TestMemTimerStore(t *testing.T) {
 
 }
 
-func BenchmarkMemIterate10K(b *testing.B) {
-	benchmarkMemIterate(10000, b)
+func TestMemTimerStoreClose(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-close", NewMemProvider())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	store, err := NewTimerStore("Close", "mem-close", 100*time.Millisecond, func(key string, val string) {
+		close(started)
+		<-release
+	})
+	equal(nil, err)
+
+	equal(nil, store.Set("first", "this is the first", 0))
+	<-started
+
+	// 回调未结束时, Close受ctx约束返回
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	equal(context.DeadlineExceeded, store.Close(ctx))
+
+	close(release)
+	store.running.Wait()
+
+	err = store.Set("second", "this is the second", 5)
+	equal(errClosed, err)
+	_, ok, err := store.Get("first")
+	equal(false, ok)
+	equal(errClosed, err)
+	equal(errClosed, store.Close(context.Background()))
 }
 
-func BenchmarkMemIterate100K(b *testing.B) {
-	benchmarkMemIterate(100000, b)
+func TestMemTimerStoreRun(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-run", NewMemProvider())
+
+	fired := make(chan string, 1)
+	store, err := NewPassiveTimerStore("Run", "mem-run", 100*time.Millisecond, func(key string, val string) {
+		fired <- key
+	})
+	equal(nil, err)
+
+	equal(nil, store.Set("first", "this is the first", 0))
+
+	// 未调用Run前不会触发回调
+	select {
+	case key := <-fired:
+		t.Fatalf("unexpected callback for %s", key)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- store.Run(ctx)
+	}()
+
+	equal("first", <-fired)
+	equal(errRunning, store.Run(ctx))
+
+	cancel()
+	equal(context.Canceled, <-result)
+
+	equal(nil, store.Close(context.Background()))
+	equal(errClosed, store.Run(context.Background()))
+
+	// 取消后只等待执行中的回调, 不再处理剩余的到期key
+	RegisterProvider("mem-run-cancel", NewMemProvider())
+	var calls int32
+	store, err = New("RunCancel", "mem-run-cancel", func(key string, val string) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+	}, WithPassive())
+	equal(nil, err)
+	for i := 0; i < 300; i++ {
+		equal(nil, store.SetAt(fmt.Sprintf("key_%d", i), "v", time.Now()))
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		result <- store.Run(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	st := time.Now()
+	cancel()
+	equal(context.Canceled, <-result)
+	equal(true, time.Since(st) < 100*time.Millisecond)
+	equal(true, atomic.LoadInt32(&calls) < 300)
+
+	equal(nil, store.Close(context.Background()))
 }
 
-func BenchmarkMemIterate1M(b *testing.B) {
-	benchmarkMemIterate(1000000, b)
+func TestMemTimerStoreAdaptive(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	m := NewMemProvider()
+	RegisterProvider("mem-adaptive", m)
+
+	fired := make(chan string, 1)
+	store, err := New("Adaptive", "mem-adaptive", func(key string, val string) {
+		fired <- key
+	}, WithInterval(time.Hour))
+	equal(nil, err)
+	defer store.Close(context.Background())
+
+	_, ok, err := m.Next()
+	equal(nil, err)
+	equal(false, ok)
+
+	// 最长等待1小时, 写入更早的key后应被提前唤醒
+	time.Sleep(50 * time.Millisecond)
+	st := time.Now()
+	equal(nil, store.SetWithTTL("first", "this is the first", 200*time.Millisecond))
+	next, ok, err := m.Next()
+	equal(nil, err)
+	equal(true, ok)
+	equal(true, next.Sub(st) > 150*time.Millisecond && next.Sub(st) < 250*time.Millisecond)
+
+	select {
+	case key := <-fired:
+		equal("first", key)
+		equal(true, time.Since(st) < 500*time.Millisecond)
+	case <-time.After(3 * time.Second):
+		t.Fatalf("callback not fired")
+	}
 }
 
-func benchmarkMemIterate(i int, b *testing.B) {
-	for j := 0; j < b.N; j++ {
-		mem := TimerStore{
-			prefix: "Test",
-			store:  NewMemProvider(),
-			h:      func(key string, val string) {},
+func TestMemProviderMillisecond(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
 		}
-		for n := 0; n < i; n++ {
-			key := fmt.Sprintf("key_%d", n)
-			val := string(fmt.Sprintf("val_%d", n))
-			mem.Set(key, val, int64(n))
+	}
+
+	mem := NewMemProvider()
+	mem.SetPrefix("Milli")
+
+	now := time.Now()
+	equal(nil, mem.SetWithTTL("first", "this is the first", 250*time.Millisecond))
+	equal(nil, mem.SetWithTTL("second", "this is the second", 750*time.Millisecond))
+
+	due, _ := mem.Claim(now.Add(100*time.Millisecond), 10, time.Minute)
+	equal(0, len(due))
+
+	due, _ = mem.Claim(now.Add(500*time.Millisecond), 10, time.Minute)
+	equal(1, len(due))
+	equal("first", due[0].Key)
+	equal("this is the first", due[0].Value)
+
+	// 已租用的key在租约期间不会再次到期
+	due, _ = mem.Claim(now.Add(time.Second), 10, time.Minute)
+	equal(1, len(due))
+	equal("second", due[0].Key)
+}
+
+func TestMemProviderClaimOrder(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
 		}
+	}
 
-		st := time.Now()
-		due, ok, _ := mem.store.Before(time.Now().Unix())
-		if ok {
-			for key, val := range due {
-				mem.h(key, val)
-				mem.store.Del(key)
-			}
+	mem := NewMemProvider()
+	mem.SetPrefix("Order")
+
+	// 逐个租用时按过期时间从早到晚取出, 大量到期key时每次只处理堆顶
+	now := time.Now().Truncate(time.Millisecond)
+	n := 20000
+	for i := n; i > 0; i-- {
+		equal(nil, mem.SetAt(fmt.Sprintf("key_%d", i), "v", now.Add(-time.Duration(i%5000)*time.Millisecond)))
+	}
+	next, ok, _ := mem.Next()
+	equal(true, ok)
+	equal(true, next.Equal(now.Add(-4999*time.Millisecond)))
+
+	last := time.Time{}
+	for i := 0; i < n; i++ {
+		evs, err := mem.Claim(now, 1, time.Minute)
+		equal(nil, err)
+		equal(1, len(evs))
+		equal(false, evs[0].Deadline.Before(last))
+		last = evs[0].Deadline
+	}
+	evs, _ := mem.Claim(now, 1, time.Minute)
+	equal(0, len(evs))
+	next, _, _ = mem.Next()
+	equal(true, next.Equal(now.Add(time.Minute)))
+}
+
+func TestMemProviderDeadline(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	mem := NewMemProvider()
+	mem.SetPrefix("Deadline")
+
+	deadline := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	equal(nil, mem.SetAt("first", "this is the first", deadline))
+	next, ok, _ := mem.Next()
+	equal(true, ok)
+	equal(true, next.Equal(deadline))
+
+	ok, err := mem.ExpireAt("first", deadline.Add(time.Minute))
+	equal(nil, err)
+	equal(true, ok)
+	next, _, _ = mem.Next()
+	equal(true, next.Equal(deadline.Add(time.Minute)))
+	equal(1, len(mem.timer))
+
+	data, ok, _ := mem.Get("first")
+	equal(true, ok)
+	equal("this is the first", data)
+
+	due, _ := mem.Claim(deadline, 10, time.Minute)
+	equal(0, len(due))
+	due, _ = mem.Claim(deadline.Add(time.Minute), 10, time.Minute)
+	equal(1, len(due))
+	equal("this is the first", due[0].Value)
+
+	ok, err = mem.ExpireAt("missing", deadline)
+	equal(nil, err)
+	equal(false, ok)
+}
+
+func TestMemTimerStoreExpire(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	m := NewMemProvider()
+	RegisterProvider("mem-expire", m)
+
+	fired := make(chan string, 1)
+	store, err := New("Expire", "mem-expire", func(key string, val string) {
+		fired <- val
+	}, WithInterval(time.Hour))
+	equal(nil, err)
+	defer store.Close(context.Background())
+
+	equal(nil, store.Set("first", "this is the first", 3600))
+
+	// 缩短到200ms后到期, value不变
+	ok, err := store.Expire("first", 200*time.Millisecond)
+	equal(nil, err)
+	equal(true, ok)
+	select {
+	case val := <-fired:
+		equal("this is the first", val)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("callback not fired")
+	}
+
+	ok, err = store.Expire("missing", time.Second)
+	equal(nil, err)
+	equal(false, ok)
+}
+
+func TestMemTimerStoreTTL(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-ttl", NewMemProvider())
+
+	// 时钟比系统时间快1小时, 写入和TTL都按此时钟计算
+	now := time.Now().Add(time.Hour)
+	store, err := New("TTL", "mem-ttl", func(key string, val string) {},
+		WithClock(fixedClock(now)), WithPassive())
+	equal(nil, err)
+
+	deadline := now.Add(90 * time.Second).Truncate(time.Millisecond)
+	equal(nil, store.SetAt("first", "this is the first", deadline))
+
+	at, ok, err := store.Deadline("first")
+	equal(nil, err)
+	equal(true, ok)
+	equal(true, at.Equal(deadline))
+
+	ttl, ok, err := store.TTL("first")
+	equal(nil, err)
+	equal(true, ok)
+	equal(deadline.Sub(now), ttl)
+
+	equal(nil, store.SetAt("second", "this is the second", now.Add(-time.Second)))
+	ttl, ok, _ = store.TTL("second")
+	equal(true, ok)
+	equal(time.Duration(0), ttl)
+
+	equal(nil, store.SetWithTTL("third", "this is the third", 10*time.Minute))
+	ttl, _, _ = store.TTL("third")
+	equal(true, ttl > 10*time.Minute-time.Millisecond && ttl <= 10*time.Minute)
+
+	_, ok, err = store.TTL("missing")
+	equal(nil, err)
+	equal(false, ok)
+}
+
+func TestMemProviderPersist(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-persist", NewMemProvider())
+
+	store, err := New("Persist", "mem-persist", func(key string, val string) {}, WithPassive())
+	equal(nil, err)
+	mem := store.store
+
+	equal(nil, store.Set("first", "this is the first", 1))
+	ok, err := store.Persist("first")
+	equal(nil, err)
+	equal(true, ok)
+
+	// 去除过期时间后不会到期, 仍可读取
+	due, _ := mem.Claim(time.Now().Add(time.Hour), 10, time.Minute)
+	equal(0, len(due))
+	_, ok, _ = mem.Next()
+	equal(false, ok)
+	data, ok, _ := store.Get("first")
+	equal(true, ok)
+	equal("this is the first", data)
+	ttl, ok, _ := store.TTL("first")
+	equal(true, ok)
+	equal(Persistent, ttl)
+
+	// 重新设置过期时间
+	ok, err = store.Expire("first", time.Minute)
+	equal(nil, err)
+	equal(true, ok)
+	due, _ = mem.Claim(time.Now().Add(time.Hour), 10, time.Minute)
+	equal(1, len(due))
+	equal("this is the first", due[0].Value)
+
+	ok, err = store.Persist("missing")
+	equal(nil, err)
+	equal(false, ok)
+}
+
+func TestMemProviderPause(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	mem := NewMemProvider()
+	mem.SetPrefix("Pause")
+
+	equal(nil, mem.SetWithTTL("first", "this is the first", 2*time.Second))
+	ok, err := mem.Pause("first")
+	equal(nil, err)
+	equal(true, ok)
+
+	// 暂停期间不会到期
+	due, _ := mem.Claim(time.Now().Add(time.Hour), 10, time.Minute)
+	equal(0, len(due))
+	time.Sleep(300 * time.Millisecond)
+
+	// 恢复后剩余时间不变
+	ok, err = mem.Resume("first")
+	equal(nil, err)
+	equal(true, ok)
+	deadline, ok, _ := mem.Deadline("first")
+	equal(true, ok)
+	left := time.Until(deadline)
+	equal(true, left > 1900*time.Millisecond && left <= 2*time.Second)
+
+	ok, _ = mem.Pause("missing")
+	equal(false, ok)
+	ok, _ = mem.Resume("missing")
+	equal(false, ok)
+}
+
+func TestMemTimerStorePauseProcessing(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-suspend", NewMemProvider())
+	RegisterProvider("mem-discard", NewMemProvider())
+
+	fired := make(chan string, 4)
+	handler := func(key string, val string) {
+		fired <- key
+	}
+
+	fire, err := New("Suspend", "mem-suspend", handler, WithInterval(50*time.Millisecond))
+	equal(nil, err)
+	defer fire.Close(context.Background())
+	discard, err := New("Discard", "mem-discard", handler,
+		WithInterval(50*time.Millisecond), WithCatchUp(CatchUpDiscard))
+	equal(nil, err)
+	defer discard.Close(context.Background())
+
+	fire.PauseProcessing()
+	discard.PauseProcessing()
+	equal(nil, fire.SetWithTTL("first", "this is the first", 100*time.Millisecond))
+	equal(nil, discard.SetWithTTL("second", "this is the second", 100*time.Millisecond))
+
+	// 读取次数用完的回调同样暂缓
+	equal(nil, fire.SetMaxReads("once", "code", time.Hour, 1))
+	equal(nil, discard.SetMaxReads("twice", "code", time.Hour, 1))
+	_, ok, _ := fire.Get("once")
+	equal(true, ok)
+	_, ok, _ = discard.Get("twice")
+	equal(true, ok)
+
+	// 暂停期间不触发回调
+	select {
+	case key := <-fired:
+		t.Fatalf("unexpected callback for %s", key)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	equal(nil, discard.ResumeProcessing())
+	_, ok, _ = discard.Get("second")
+	equal(false, ok)
+
+	equal(nil, fire.ResumeProcessing())
+	keys := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case key := <-fired:
+			keys[key] = true
+		case <-time.After(time.Second):
+			t.Fatalf("callback not fired")
+		}
+	}
+	equal(true, keys["first"])
+	equal(true, keys["once"])
+
+	select {
+	case key := <-fired:
+		t.Fatalf("unexpected callback for %s", key)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMemProviderSetNX(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	mem := NewMemProvider()
+	mem.SetPrefix("SetNX")
+
+	ok, err := mem.SetXX("first", "this is the first", time.Minute)
+	equal(nil, err)
+	equal(false, ok)
+	_, ok, _ = mem.Get("first")
+	equal(false, ok)
+
+	ok, err = mem.SetNX("first", "this is the first", time.Minute)
+	equal(nil, err)
+	equal(true, ok)
+	ok, err = mem.SetNX("first", "this is the first replacement", time.Hour)
+	equal(nil, err)
+	equal(false, ok)
+	data, _, _ := mem.Get("first")
+	equal("this is the first", data)
+
+	ok, err = mem.SetXX("first", "this is the first replacement", time.Hour)
+	equal(nil, err)
+	equal(true, ok)
+	data, _, _ = mem.Get("first")
+	equal("this is the first replacement", data)
+	due, _ := mem.Claim(time.Now().Add(2*time.Minute), 10, time.Minute)
+	equal(0, len(due))
+	equal(1, len(mem.timer))
+}
+
+func TestMemTimerStoreCompareAndSet(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-cas", NewMemProvider())
+
+	store, err := New("CAS", "mem-cas", func(key string, val string) {}, WithPassive())
+	equal(nil, err)
+
+	// 版本号0表示key不存在
+	equal(nil, store.CompareAndSet("first", "1", time.Minute, 0))
+	equal(errVersionMismatch, store.CompareAndSet("first", "1", time.Minute, 0))
+
+	data, version, ok, err := store.GetWithVersion("first")
+	equal(nil, err)
+	equal(true, ok)
+	equal("1", data)
+	equal(uint64(1), version)
+
+	equal(nil, store.Set("first", "2", 60))
+	err = store.CompareAndSet("first", "3", time.Minute, version)
+	equal(errVersionMismatch, err)
+	equal(uint32(5), err.(*TimerError).Code)
+
+	_, version, _, _ = store.GetWithVersion("first")
+	equal(uint64(2), version)
+	equal(nil, store.CompareAndSet("first", "3", time.Minute, version))
+	data, version, _, _ = store.GetWithVersion("first")
+	equal("3", data)
+	equal(uint64(3), version)
+
+	// 删除后重新写入不会重复使用版本号, 删除前读到的版本号不能再写入
+	stale := version
+	_, _, _ = store.Take("first")
+	for i := 0; i < 3; i++ {
+		equal(nil, store.Set("first", "4", 60))
+	}
+	equal(errVersionMismatch, store.CompareAndSet("first", "5", time.Minute, stale))
+	_, version, _, _ = store.GetWithVersion("first")
+	equal(uint64(6), version)
+}
+
+func TestMemTimerStoreTake(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-take", NewMemProvider())
+
+	fired := make(chan string, 2)
+	store, err := New("Take", "mem-take", func(key string, val string) {
+		fired <- key
+	}, WithClock(fixedClock(time.Now().Add(time.Hour))), WithPassive())
+	equal(nil, err)
+
+	equal(nil, store.SetAt("first", "this is the first", time.Now().Add(5*time.Second)))
+	equal(nil, store.SetAt("second", "this is the second", time.Now().Add(5*time.Second)))
+
+	data, ok, err := store.Take("first")
+	equal(nil, err)
+	equal(true, ok)
+	equal("this is the first", data)
+	_, ok, _ = store.Take("first")
+	equal(false, ok)
+	_, ok, _ = store.Get("first")
+	equal(false, ok)
+
+	// 被取走的key不会执行回调
+	store.process(context.Background())
+	close(fired)
+	equal("second", <-fired)
+	_, ok = <-fired
+	equal(false, ok)
+}
+
+func TestMemTimerStoreMany(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-many", NewMemProvider())
+
+	store, err := New("Many", "mem-many", func(key string, val string) {}, WithPassive())
+	equal(nil, err)
+
+	var items []Item
+	for i := 0; i < 250; i++ {
+		items = append(items, Item{
+			Key:   fmt.Sprintf("key_%d", i),
+			Value: fmt.Sprintf("val_%d", i),
+			TTL:   time.Duration(i) * time.Second,
+		})
+	}
+	errs := store.SetMany(items)
+	equal(250, len(errs))
+	for _, err := range errs {
+		equal(nil, err)
+	}
+
+	results := store.GetMany([]string{"key_0", "missing", "key_249"})
+	equal(3, len(results))
+	equal("val_0", results[0].Value)
+	equal(true, results[0].OK)
+	equal(false, results[1].OK)
+	equal(nil, results[1].Err)
+	equal("val_249", results[2].Value)
+
+	errs = store.DelMany([]string{"key_0", "missing"})
+	equal(2, len(errs))
+	equal(nil, errs[0])
+	equal(nil, errs[1])
+	_, ok, _ := store.Get("key_0")
+	equal(false, ok)
+	_, ok, _ = store.Get("key_1")
+	equal(true, ok)
+}
+
+func TestMemTimerStoreTxn(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-txn", NewMemProvider())
+
+	store, err := New("Txn", "mem-txn", func(key string, val string) {}, WithPassive())
+	equal(nil, err)
+
+	equal(nil, store.Set("hold", "seat-1", 60))
+	_, version, _, _ := store.GetWithVersion("hold")
+
+	// 前置条件不满足时不执行任何操作
+	err = store.Txn().
+		IfVersion("hold", version+1).
+		Set("seat", "booked", time.Hour).
+		Del("hold").
+		Commit()
+	equal(errVersionMismatch, err)
+	_, ok, _ := store.Get("seat")
+	equal(false, ok)
+	_, ok, _ = store.Get("hold")
+	equal(true, ok)
+
+	err = store.Txn().
+		IfVersion("hold", version).
+		IfVersion("seat", 0).
+		Set("seat", "booked", time.Hour).
+		Del("hold").
+		Expire("missing", time.Minute).
+		Commit()
+	equal(nil, err)
+	data, ok, _ := store.Get("seat")
+	equal(true, ok)
+	equal("booked", data)
+	_, ok, _ = store.Get("hold")
+	equal(false, ok)
+	_, ok, _ = store.Get("missing")
+	equal(false, ok)
+
+	equal(nil, store.Txn().Expire("seat", time.Minute).Commit())
+	ttl, _, _ := store.TTL("seat")
+	equal(true, ttl <= time.Minute && ttl > 50*time.Second)
+}
+
+func TestMemTimerStoreIncrBy(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-incr", NewMemProvider())
+
+	store, err := New("Incr", "mem-incr", func(key string, val string) {}, WithPassive())
+	equal(nil, err)
+
+	n, err := store.IncrBy("counter", 5, time.Minute)
+	equal(nil, err)
+	equal(int64(5), n)
+	deadline, _, _ := store.Deadline("counter")
+
+	// 已存在的key不修改过期时间
+	n, err = store.IncrBy("counter", -7, time.Hour)
+	equal(nil, err)
+	equal(int64(-2), n)
+	again, _, _ := store.Deadline("counter")
+	equal(true, again.Equal(deadline))
+	data, version, _, _ := store.GetWithVersion("counter")
+	equal("-2", data)
+	equal(uint64(2), version)
+
+	equal(nil, store.Set("text", "hello", 60))
+	_, err = store.IncrBy("text", 1, time.Minute)
+	equal(errNotInteger, err)
+}
+
+func TestMemTimerStoreSliding(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-sliding", NewMemProvider())
+
+	store, err := New("Sliding", "mem-sliding", func(key string, val string) {}, WithPassive())
+	equal(nil, err)
+
+	equal(nil, store.SetSliding("session", "alice", 200*time.Millisecond))
+	equal(nil, store.SetWithTTL("plain", "bob", 200*time.Millisecond))
+	session, _, _ := store.Deadline("session")
+	plain, _, _ := store.Deadline("plain")
+
+	time.Sleep(50 * time.Millisecond)
+
+	// 读取后滑动过期的key重新定时, 普通key不变
+	data, ok, err := store.Get("session")
+	equal(nil, err)
+	equal(true, ok)
+	equal("alice", data)
+	moved, _, _ := store.Deadline("session")
+	equal(true, moved.After(session))
+	store.Get("plain")
+	again, _, _ := store.Deadline("plain")
+	equal(true, again.Equal(plain))
+
+	// 启用WithSliding后所有key都重新定时, 暂停的key不受影响
+	RegisterProvider("mem-sliding-all", NewMemProvider())
+	all, err := New("SlidingAll", "mem-sliding-all", func(key string, val string) {}, WithPassive(), WithSliding())
+	equal(nil, err)
+	equal(nil, all.SetWithTTL("plain", "bob", 200*time.Millisecond))
+	plain, _, _ = all.Deadline("plain")
+	time.Sleep(50 * time.Millisecond)
+	all.Get("plain")
+	moved, _, _ = all.Deadline("plain")
+	equal(true, moved.After(plain))
+
+	all.Pause("plain")
+	all.Get("plain")
+	deadline, _, _ := all.Deadline("plain")
+	equal(true, deadline.IsZero())
+}
+
+func TestMemTimerStoreMaxReads(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-reads", NewMemProvider())
+
+	fired := make(chan string, 2)
+	store, err := New("Reads", "mem-reads", func(key string, val string) {}, WithPassive(),
+		WithReasonHandler(func(key string, val string, reason Reason) {
+			fired <- fmt.Sprintf("%s:%s:%d", key, val, reason)
+		}))
+	equal(nil, err)
+
+	equal(nil, store.SetMaxReads("token", "file", time.Minute, 3))
+
+	// GetWithVersion和GetMany与Get相同地扣减读取次数
+	_, _, ok, _ := store.GetWithVersion("token")
+	equal(true, ok)
+	results := store.GetMany([]string{"token"})
+	equal(true, results[0].OK)
+	equal(false, results[0].Exhausted)
+	equal(0, len(fired))
+
+	// 最后一次读取仍返回value, 随后删除key并执行回调
+	data, ok, err := store.Get("token")
+	equal(nil, err)
+	equal(true, ok)
+	equal("file", data)
+	equal(fmt.Sprintf("token:file:%d", ReasonReadsExhausted), <-fired)
+
+	_, ok, _ = store.Get("token")
+	equal(false, ok)
+
+	// GetMany用完读取次数时同样执行回调
+	equal(nil, store.SetMaxReads("once", "code", time.Minute, 1))
+	results = store.GetMany([]string{"once", "once"})
+	equal(true, results[0].OK)
+	equal(true, results[0].Exhausted)
+	equal("code", results[0].Value)
+	equal(false, results[1].OK)
+	equal(fmt.Sprintf("once:code:%d", ReasonReadsExhausted), <-fired)
+
+	// 先到期时按普通过期处理
+	equal(nil, store.SetMaxReads("link", "url", 50*time.Millisecond, 5))
+	store.Get("link")
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	store.Run(ctx)
+	equal(fmt.Sprintf("link:url:%d", ReasonExpired), <-fired)
+
+	equal(nil, store.Close(context.Background()))
+}
+
+func TestParseSchedule(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	equal(nil, err)
+	// 2024-03-01 是周五
+	from := time.Date(2024, 3, 1, 8, 30, 0, 0, shanghai)
+
+	cases := []struct {
+		spec string
+		next time.Time
+	}{
+		{"TZ=Asia/Shanghai 0 9 * * *", time.Date(2024, 3, 1, 9, 0, 0, 0, shanghai)},
+		{"TZ=Asia/Shanghai */20 * * * *", time.Date(2024, 3, 1, 8, 40, 0, 0, shanghai)},
+		{"TZ=Asia/Shanghai 0 9 * * 1-5", time.Date(2024, 3, 1, 9, 0, 0, 0, shanghai)},
+		{"TZ=Asia/Shanghai 0 9 * * 0,6", time.Date(2024, 3, 2, 9, 0, 0, 0, shanghai)},
+		{"TZ=Asia/Shanghai 0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, shanghai)},
+		{"TZ=UTC @daily", time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", from.Add(90 * time.Second)},
+		{"TZ=Asia/Shanghai 0 0 30 2 *", time.Time{}},
+	}
+	for _, c := range cases {
+		sched, err := ParseSchedule(c.spec)
+		equal(nil, err)
+		equal(true, sched.Next(from).Equal(c.next))
+	}
+
+	// 夏令时切换的间隙中仍然向后查找, 不存在的时刻跳到下一次
+	newYork, _ := time.LoadLocation("America/New_York")
+	havana, _ := time.LoadLocation("America/Havana")
+	santiago, _ := time.LoadLocation("America/Santiago")
+	saoPaulo, _ := time.LoadLocation("America/Sao_Paulo")
+	dst := []struct {
+		spec string
+		from time.Time
+		next time.Time
+	}{
+		{"TZ=America/New_York 0 9 * * *", time.Date(2026, 3, 7, 15, 0, 0, 0, time.UTC), time.Date(2026, 3, 8, 9, 0, 0, 0, newYork)},
+		{"TZ=America/New_York 30 2 * * *", time.Date(2026, 3, 7, 15, 0, 0, 0, time.UTC), time.Date(2026, 3, 9, 2, 30, 0, 0, newYork)},
+		{"TZ=America/Havana 0 12 * * 1", time.Date(2026, 3, 7, 12, 0, 0, 0, time.UTC), time.Date(2026, 3, 9, 12, 0, 0, 0, havana)},
+		{"TZ=America/Santiago 0 12 * * 1", time.Date(2026, 9, 5, 12, 0, 0, 0, time.UTC), time.Date(2026, 9, 7, 12, 0, 0, 0, santiago)},
+		{"TZ=America/Sao_Paulo 0 12 * * 1", time.Date(2018, 11, 3, 12, 0, 0, 0, time.UTC), time.Date(2018, 11, 5, 12, 0, 0, 0, saoPaulo)},
+	}
+	for _, c := range dst {
+		sched, err := ParseSchedule(c.spec)
+		equal(nil, err)
+		equal(true, sched.Next(c.from).Equal(c.next))
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "@every -1s", "TZ=Nowhere/City 0 9 * * *", "5-1 * * * *"} {
+		_, err := ParseSchedule(spec)
+		equal(errInvalidSpec.Code, err.(*TimerError).Code)
+	}
+}
+
+func TestMemTimerStoreRecurring(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-recurring", NewMemProvider())
+
+	var mutex sync.Mutex
+	fired := 0
+	store, err := New("Recurring", "mem-recurring", func(key string, val string) {
+		mutex.Lock()
+		fired++
+		mutex.Unlock()
+	}, WithPassive())
+	equal(nil, err)
+
+	_, ok := store.SetRecurring("report", "daily", "0 0 30 2 *").(*TimerError)
+	equal(true, ok)
+
+	equal(nil, store.SetRecurring("tick", "every", "@every 100ms"))
+	first, _, _ := store.Deadline("tick")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 350*time.Millisecond)
+	defer cancel()
+	store.Run(ctx)
+
+	// 每次触发后重新定时, key一直存在
+	mutex.Lock()
+	equal(3, fired)
+	mutex.Unlock()
+	data, ok, _ := store.Get("tick")
+	equal(true, ok)
+	equal("every", data)
+	next, _, _ := store.Deadline("tick")
+	equal(true, next.Equal(first.Add(300*time.Millisecond)))
+
+	equal(nil, store.Close(context.Background()))
+}
+
+func TestMemTimerStoreAction(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-action", NewMemProvider())
+
+	var mutex sync.Mutex
+	calls := make(map[string]int)
+	var store *TimerStore
+	store, err := New("Action", "mem-action", func(key string, val string) {}, WithPassive(),
+		WithActionHandler(func(key string, val string) Action {
+			mutex.Lock()
+			calls[key]++
+			n := calls[key]
+			mutex.Unlock()
+
+			switch key {
+			case "snooze":
+				if n == 1 {
+					return RescheduleAfter(time.Hour)
+				}
+			case "replace":
+				return ReplaceValue(val+"!", time.Hour)
+			case "keep":
+				return Keep()
+			case "recurring":
+				return Delete()
+			case "tick":
+				return Keep()
+			case "changed":
+				// 回调期间key被重新写入, 返回的动作不再执行
+				store.SetWithTTL("changed", "new", time.Hour)
+				return Keep()
+			}
+			return Delete()
+		}))
+	equal(nil, err)
+
+	for _, key := range []string{"snooze", "replace", "keep", "changed", "gone"} {
+		equal(nil, store.SetWithTTL(key, key, 10*time.Millisecond))
+	}
+	equal(nil, store.SetRecurring("recurring", "recurring", "@every 10ms"))
+	equal(nil, store.SetRecurring("tick", "tick", "@every 1h"))
+	_, err = store.ExpireAt("tick", time.Now())
+	equal(nil, err)
+
+	time.Sleep(30 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	store.Run(ctx)
+
+	ttl, ok, _ := store.TTL("snooze")
+	equal(true, ok)
+	equal(true, ttl > 59*time.Minute)
+	data, _, _ := store.Get("replace")
+	equal("replace!", data)
+	ttl, ok, _ = store.TTL("keep")
+	equal(true, ok)
+	equal(Persistent, ttl)
+	data, _, _ = store.Get("changed")
+	equal("new", data)
+	_, ok, _ = store.Get("gone")
+	equal(false, ok)
+	_, ok, _ = store.Get("recurring")
+	equal(false, ok)
+	// 周期key返回Keep时按规则继续定时
+	ttl, ok, _ = store.TTL("tick")
+	equal(true, ok)
+	equal(true, ttl > 59*time.Minute)
+	mutex.Lock()
+	equal(1, calls["recurring"])
+	equal(1, calls["tick"])
+	mutex.Unlock()
+
+	equal(nil, store.Close(context.Background()))
+
+	// 只设置ActionHandler时, 读取次数用完不执行回调
+	RegisterProvider("mem-action-nil", NewMemProvider())
+	store, err = New("ActionNil", "mem-action-nil", nil, WithPassive(),
+		WithActionHandler(func(key string, val string) Action { return Delete() }))
+	equal(nil, err)
+	equal(nil, store.SetMaxReads("once", "code", time.Minute, 1))
+	data, ok, err = store.Get("once")
+	equal(nil, err)
+	equal("code", data)
+	_, ok, _ = store.Get("once")
+	equal(false, ok)
+	equal(nil, store.Close(context.Background()))
+}
+
+func TestMemTimerStoreEvent(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-event", NewMemProvider())
+
+	events := make(chan Event, 2)
+	failed := make(chan error, 2)
+	fail := fmt.Errorf("downstream unavailable")
+	store, err := New("Event", "mem-event", nil, WithPassive(),
+		WithEventHandler(func(ctx context.Context, ev Event) error {
+			events <- ev
+			return fail
+		}),
+		WithErrorHandler(func(err error) {
+			failed <- err
+		}))
+	equal(nil, err)
+
+	deadline := time.Now().Add(20 * time.Millisecond).Truncate(time.Millisecond)
+	equal(nil, store.SetAt("order", "paid", deadline))
+	time.Sleep(30 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	store.Run(ctx)
+
+	ev := <-events
+	equal("order", ev.Key)
+	equal("paid", ev.Value)
+	equal(true, ev.Deadline.Equal(deadline))
+	equal(true, !ev.FiredAt.Before(deadline))
+	equal(1, ev.Attempt)
+	equal("Event", ev.Store)
+	equal(ReasonExpired, ev.Reason)
+	equal(fail, <-failed)
+
+	// 读取次数用完时没有计划的触发时间
+	equal(nil, store.SetMaxReads("token", "file", time.Minute, 1))
+	store.Get("token")
+	ev = <-events
+	equal(ReasonReadsExhausted, ev.Reason)
+	equal(true, ev.Deadline.IsZero())
+
+	equal(nil, store.Close(context.Background()))
+}
+
+func TestMemTimerStoreRetry(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	policy := RetryPolicy{MaxAttempts: 3, Initial: 10 * time.Millisecond, Max: 15 * time.Millisecond}
+	equal(10*time.Millisecond, policy.backoff(1))
+	equal(15*time.Millisecond, policy.backoff(2))
+	policy.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := policy.backoff(1)
+		equal(true, d >= 5*time.Millisecond && d <= 15*time.Millisecond)
+	}
+
+	RegisterProvider("mem-retry", NewMemProvider())
+
+	var mutex sync.Mutex
+	attempts := make(map[string][]int)
+	store, err := New("Retry", "mem-retry", nil, WithPassive(),
+		WithRetry(RetryPolicy{MaxAttempts: 3, Initial: 10 * time.Millisecond}),
+		WithErrorHandler(func(err error) {}),
+		WithEventHandler(func(ctx context.Context, ev Event) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			attempts[ev.Key] = append(attempts[ev.Key], ev.Attempt)
+			if ev.Key == "flaky" && ev.Attempt == 2 {
+				return nil
+			}
+			return fmt.Errorf("attempt %d failed", ev.Attempt)
+		}))
+	equal(nil, err)
+
+	equal(nil, store.SetWithTTL("flaky", "call", 10*time.Millisecond))
+	equal(nil, store.SetWithTTL("down", "call", 10*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	store.Run(ctx)
+
+	mutex.Lock()
+	equal("[1 2]", fmt.Sprint(attempts["flaky"]))
+	equal("[1 2 3]", fmt.Sprint(attempts["down"]))
+	mutex.Unlock()
+
+	// 重试用完后key被删除
+	_, ok, _ := store.Get("down")
+	equal(false, ok)
+
+	equal(nil, store.Close(context.Background()))
+}
+
+func TestMemTimerStoreClaim(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	mem := NewMemProvider()
+	mem.SetPrefix("Claim")
+	now := time.Now()
+	equal(nil, mem.SetAt("k", "v", now))
+
+	evs, err := mem.Claim(now, 10, time.Minute)
+	equal(nil, err)
+	equal(1, len(evs))
+	ev := evs[0]
+	equal("k", ev.Key)
+	equal("v", ev.Value)
+	equal(1, ev.Attempt)
+
+	// 租约期间不会被再次租用, 未确认时租约过期后重新到期
+	evs, _ = mem.Claim(now, 10, time.Minute)
+	equal(0, len(evs))
+	evs, _ = mem.Claim(now.Add(2*time.Minute), 10, time.Minute)
+	equal(1, len(evs))
+	equal(2, evs[0].Attempt)
+	equal(true, evs[0].Deadline.Equal(ev.Deadline))
+
+	// 过期的租约不能再确认
+	ok, _ := mem.Ack(ev.ID, nil)
+	equal(false, ok)
+
+	ok, _ = mem.Nack(evs[0].ID, now.Add(time.Second))
+	equal(true, ok)
+	d, _, _ := mem.Deadline("k")
+	equal(true, d.Equal(now.Add(time.Second).Truncate(time.Millisecond)))
+
+	evs, _ = mem.Claim(now.Add(time.Second), 10, time.Minute)
+	equal(3, evs[0].Attempt)
+	ok, _ = mem.Ack(evs[0].ID, nil)
+	equal(true, ok)
+	_, ok, _ = mem.Get("k")
+	equal(false, ok)
+
+	// 确认时对key执行的操作与确认是原子的
+	equal(nil, mem.SetAt("k", "v", now))
+	evs, _ = mem.Claim(now, 10, time.Minute)
+	ok, _ = mem.Ack(evs[0].ID, []TxnOp{{Type: TxnSet, Value: "x", TTL: time.Hour}})
+	equal(true, ok)
+	val, _, _ := mem.Get("k")
+	equal("x", val)
+	equal(nil, mem.Del("k"))
+
+	// 租约期间被重新写入的key不受确认影响
+	equal(nil, mem.SetAt("k", "v", now))
+	evs, _ = mem.Claim(now, 10, time.Minute)
+	equal(nil, mem.SetWithTTL("k", "w", time.Hour))
+	ok, _ = mem.Ack(evs[0].ID, []TxnOp{{Type: TxnDel}})
+	equal(false, ok)
+	val, _, _ = mem.Get("k")
+	equal("w", val)
+
+	// 租约期间修改过期时间或value后, 确认不再删除key
+	equal(nil, mem.SetAt("k", "1", now))
+	evs, _ = mem.Claim(now, 10, time.Minute)
+	d, _, _ = mem.Deadline("k")
+	equal(true, d.Equal(now.Truncate(time.Millisecond)))
+	_, ok, _ = mem.Take("k")
+	equal(false, ok)
+	ok, _ = mem.Expire("k", time.Hour)
+	equal(true, ok)
+	ok, _ = mem.Ack(evs[0].ID, nil)
+	equal(false, ok)
+	d, _, _ = mem.Deadline("k")
+	equal(true, d.After(now.Add(59*time.Minute)))
+
+	// 回调执行中的计数窗口已结束, 计数写入新的窗口
+	equal(nil, mem.SetAt("k", "1", now))
+	evs, _ = mem.Claim(now, 10, time.Minute)
+	n, created, err := mem.IncrBy("k", 1, time.Hour)
+	equal(nil, err)
+	equal(true, created)
+	equal(int64(1), n)
+	ok, _ = mem.Ack(evs[0].ID, nil)
+	equal(false, ok)
+	val, _, _ = mem.Get("k")
+	equal("1", val)
+	d, _, _ = mem.Deadline("k")
+	equal(true, d.After(now.Add(59*time.Minute)))
+
+	// 回调执行中暂停的key按原计划计算剩余时间, 恢复后立即到期
+	equal(nil, mem.SetAt("k", "1", now))
+	evs, _ = mem.Claim(now, 10, time.Minute)
+	ok, _ = mem.Pause("k")
+	equal(true, ok)
+	ok, _ = mem.Ack(evs[0].ID, nil)
+	equal(false, ok)
+	ok, _ = mem.Resume("k")
+	equal(true, ok)
+	d, _, _ = mem.Deadline("k")
+	equal(true, d.Before(time.Now().Add(time.Second)))
+
+	// 租约过期后可以取出
+	evs, _ = mem.Claim(time.Now(), 10, time.Minute)
+	equal(1, len(evs))
+	mem.SetClock(fixedClock(time.Now().Add(2 * time.Minute)))
+	val, ok, _ = mem.Take("k")
+	equal(true, ok)
+	equal("1", val)
+	mem.SetClock(sysClock{})
+
+	// 回调执行中进程退出, 租约过期后由其他实例重新执行
+	RegisterProvider("mem-claim", NewMemProvider())
+	var mutex sync.Mutex
+	var got []Event
+	store, err := New("Claim", "mem-claim", nil, WithPassive(), WithVisibility(20*time.Millisecond),
+		WithEventHandler(func(ctx context.Context, ev Event) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			got = append(got, ev)
+			return nil
+		}))
+	equal(nil, err)
+
+	equal(nil, store.SetWithTTL("job", "run", time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	evs, _ = store.store.Claim(time.Now(), 10, 20*time.Millisecond)
+	equal(1, len(evs))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	store.Run(ctx)
+
+	mutex.Lock()
+	equal(1, len(got))
+	equal("job", got[0].Key)
+	equal(2, got[0].Attempt)
+	mutex.Unlock()
+	_, ok, _ = store.Get("job")
+	equal(false, ok)
+
+	equal(nil, store.Close(context.Background()))
+
+	// 回调执行中的key不能被取出, 回调期间修改过期时间的key在回调结束后保留
+	RegisterProvider("mem-claim-running", NewMemProvider())
+	started := make(chan string, 2)
+	finish := make(chan struct{})
+	store, err = New("Running", "mem-claim-running", nil, WithPassive(), WithConcurrency(2),
+		WithEventHandler(func(ctx context.Context, ev Event) error {
+			started <- ev.Key
+			<-finish
+			return nil
+		}))
+	equal(nil, err)
+
+	equal(nil, store.SetWithTTL("take", "t", time.Millisecond))
+	equal(nil, store.SetWithTTL("expire", "e", time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		store.Run(ctx)
+		close(done)
+	}()
+	<-started
+	<-started
+
+	_, ok, err = store.Take("take")
+	equal(nil, err)
+	equal(false, ok)
+	ok, _ = store.Expire("expire", time.Hour)
+	equal(true, ok)
+	close(finish)
+	cancel()
+	<-done
+
+	_, ok, _ = store.Get("take")
+	equal(false, ok)
+	ttl, ok, _ := store.TTL("expire")
+	equal(true, ok)
+	equal(true, ttl > 59*time.Minute)
+
+	equal(nil, store.Close(context.Background()))
+}
+
+// failingClaim Claim总是失败的provider, 模拟redis拒绝写入但仍可读取的情况
+type failingClaim struct {
+	*memProvider
+	calls int32
+}
+
+func (f *failingClaim) Claim(now time.Time, limit int, visibility time.Duration) ([]Event, error) {
+	atomic.AddInt32(&f.calls, 1)
+	return nil, fmt.Errorf("OOM command not allowed")
+}
+
+func TestMemTimerStoreClaimError(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	p := &failingClaim{memProvider: NewMemProvider()}
+	RegisterProvider("mem-claim-error", p)
+
+	var errs int32
+	store, err := New("ClaimError", "mem-claim-error", func(key string, val string) {}, WithPassive(),
+		WithInterval(time.Second),
+		WithErrorHandler(func(err error) {
+			atomic.AddInt32(&errs, 1)
+		}))
+	equal(nil, err)
+	equal(nil, store.SetAt("due", "v", time.Now().Add(-time.Second)))
+
+	// 租用失败后等待interval再重试, 不会因为已到期的key一直空转
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	store.Run(ctx)
+	equal(int32(1), atomic.LoadInt32(&p.calls))
+	equal(int32(1), atomic.LoadInt32(&errs))
+
+	equal(nil, store.Close(context.Background()))
+}
+
+func TestMemTimerStoreDeadLetter(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-dead", NewMemProvider())
+
+	var mutex sync.Mutex
+	healthy := false
+	store, err := New("Dead", "mem-dead", nil, WithPassive(), WithDeadLetter(),
+		WithRetry(RetryPolicy{MaxAttempts: 2, Initial: 10 * time.Millisecond}),
+		WithErrorHandler(func(err error) {}),
+		WithEventHandler(func(ctx context.Context, ev Event) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if healthy {
+				return nil
+			}
+			return fmt.Errorf("%s failed", ev.Key)
+		}))
+	equal(nil, err)
+
+	equal(nil, store.SetWithTTL("a", "1", 10*time.Millisecond))
+	equal(nil, store.SetWithTTL("b", "2", 10*time.Millisecond))
+	equal(nil, store.SetRecurring("r", "3", "@every 1h"))
+	_, err = store.ExpireAt("r", time.Now().Add(10*time.Millisecond))
+	equal(nil, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	store.Run(ctx)
+
+	letters, err := store.DeadLetters()
+	equal(nil, err)
+	equal(3, len(letters))
+	equal("a", letters[0].Key)
+	equal("1", letters[0].Value)
+	equal(2, letters[0].Attempts)
+	equal("a failed", letters[0].Err)
+	_, ok, _ := store.Get("a")
+	equal(false, ok)
+
+	// 同名key存在时不重放
+	equal(nil, store.SetWithTTL("a", "new", time.Hour))
+	ok, err = store.ReplayDeadLetter("a", 10*time.Millisecond)
+	equal(nil, err)
+	equal(false, ok)
+	store.Take("a")
+
+	mutex.Lock()
+	healthy = true
+	mutex.Unlock()
+	ok, err = store.ReplayDeadLetter("a", 10*time.Millisecond)
+	equal(nil, err)
+	equal(true, ok)
+	data, _, _ := store.Get("a")
+	equal("1", data)
+
+	// 周期key的死信保留定时规则, 重放成功后按规则继续
+	equal("@every 1h", letters[2].Spec)
+	store.Take("r")
+	ok, err = store.ReplayDeadLetter("r", 10*time.Millisecond)
+	equal(nil, err)
+	equal(true, ok)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	store.Run(ctx)
+	_, ok, _ = store.Get("a")
+	equal(false, ok)
+	ttl, ok, _ := store.TTL("r")
+	equal(true, ok)
+	equal(true, ttl > 59*time.Minute)
+
+	letters, _ = store.DeadLetters()
+	equal(1, len(letters))
+	n, err := store.PurgeDeadLetters()
+	equal(nil, err)
+	equal(1, n)
+	letters, _ = store.DeadLetters()
+	equal(0, len(letters))
+
+	equal(nil, store.Close(context.Background()))
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestMemTimerStoreOptions(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	RegisterProvider("mem-options", NewMemProvider())
+
+	// 两个回调需同时执行才能结束
+	var barrier sync.WaitGroup
+	barrier.Add(2)
+	fired := make(chan string, 2)
+	store, err := New("Options", "mem-options", func(key string, val string) {
+		barrier.Done()
+		barrier.Wait()
+		fired <- key
+	},
+		WithInterval(100*time.Millisecond),
+		WithClock(fixedClock(time.Now().Add(200*time.Second))),
+		WithConcurrency(2),
+		WithPassive(),
+	)
+	equal(nil, err)
+	equal(100*time.Millisecond, store.interval)
+	equal(true, store.passive)
+
+	equal(nil, store.SetAt("first", "this is the first", time.Now().Add(100*time.Second)))
+	equal(nil, store.SetAt("second", "this is the second", time.Now().Add(150*time.Second)))
+
+	store.process(context.Background())
+	close(fired)
+
+	got := make(map[string]bool)
+	for key := range fired {
+		got[key] = true
+	}
+	equal(2, len(got))
+	equal(true, got["first"])
+	equal(true, got["second"])
+}
+
+func BenchmarkMemIterate10K(b *testing.B) {
+	benchmarkMemIterate(10000, b)
+}
+
+func BenchmarkMemIterate100K(b *testing.B) {
+	benchmarkMemIterate(100000, b)
+}
+
+func BenchmarkMemIterate1M(b *testing.B) {
+	benchmarkMemIterate(1000000, b)
+}
+
+func benchmarkMemIterate(i int, b *testing.B) {
+	for j := 0; j < b.N; j++ {
+		mem := TimerStore{
+			prefix:  "Test",
+			store:   NewMemProvider(),
+			clock:   sysClock{},
+			onEvent: Handler(func(key string, val string) {}).EventHandler(),
+		}
+		for n := 0; n < i; n++ {
+			key := fmt.Sprintf("key_%d", n)
+			val := string(fmt.Sprintf("val_%d", n))
+			mem.Set(key, val, int64(n))
+		}
+
+		st := time.Now()
+		due, _ := mem.store.Claim(time.Now(), i, time.Minute)
+		for _, ev := range due {
+			mem.onEvent(context.Background(), ev)
+			mem.store.Ack(ev.ID, nil)
 		}
 		cost := time.Since(st) / time.Microsecond
 		fmt.Printf("i: %d, cost: %d\n", i, cost)
@@ -0,0 +1,185 @@
+package timerstore
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultInterval   = 1 * time.Second
+	defaultVisibility = 30 * time.Second
+	claimBatch        = 100 // 不执行回调时每次租用的key个数
+)
+
+// Option 构造TimerStore时的可选配置
+type Option func(*TimerStore)
+
+// Logger 定时器内部使用的日志接口
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Clock 定时器判断到期时使用的时钟, 测试时可替换
+type Clock interface {
+	Now() time.Time
+}
+
+// ErrorHandler 遍历或删除过程中出错时的回调
+type ErrorHandler func(err error)
+
+// CatchUp 恢复到期处理时, 对暂停期间到期的key的处理策略
+type CatchUp int
+
+const (
+	// CatchUpFire 恢复后立即触发暂停期间到期的所有key
+	CatchUpFire CatchUp = iota
+	// CatchUpDiscard 恢复时删除暂停期间到期的所有key, 不触发回调, 暂停期间读取次数用完的回调同样丢弃
+	CatchUpDiscard
+)
+
+// RetryPolicy 回调返回error时的重试策略, 零值表示不重试
+// 第n次重试前等待 Initial*2^(n-1), 不超过Max, 再随机浮动±Jitter的比例
+type RetryPolicy struct {
+	MaxAttempts int           // 最多执行回调的次数, 包括第一次
+	Initial     time.Duration // 第一次重试前的等待时间
+	Max         time.Duration // 等待时间上限, 为0表示不限制
+	Jitter      float64       // 随机浮动的比例, 取值0~1
+}
+
+// backoff 返回已失败attempt次后重试前的等待时间
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Initial
+	for i := 1; i < attempt && (p.Max <= 0 || d < p.Max); i++ {
+		d *= 2
+	}
+	if p.Max > 0 && d > p.Max {
+		d = p.Max
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	fmt.Printf(format+"\n", v...)
+}
+
+type sysClock struct{}
+
+func (sysClock) Now() time.Time {
+	return time.Now()
+}
+
+// WithInterval 设置没有更早到期key时循环遍历的最长间隔, 默认1秒
+func WithInterval(interval time.Duration) Option {
+	return func(t *TimerStore) {
+		t.interval = interval
+	}
+}
+
+// WithLogger 设置日志输出, 默认输出到标准输出
+func WithLogger(logger Logger) Option {
+	return func(t *TimerStore) {
+		t.logger = logger
+	}
+}
+
+// WithClock 设置时钟, 默认使用系统时间
+// 时钟同时传给provider, 写入时的过期时间, TTL, 到期判断和重试时间都按此时钟计算
+func WithClock(clock Clock) Option {
+	return func(t *TimerStore) {
+		t.clock = clock
+	}
+}
+
+// WithErrorHandler 设置出错时的回调, 默认只打印日志
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(t *TimerStore) {
+		t.onError = h
+	}
+}
+
+// WithConcurrency 设置同时执行回调的最大数量, 默认为1即串行执行
+func WithConcurrency(n int) Option {
+	return func(t *TimerStore) {
+		t.concurrency = n
+	}
+}
+
+// WithPassive 构造后不自动遍历, 由调用方调用Run驱动
+func WithPassive() Option {
+	return func(t *TimerStore) {
+		t.passive = true
+	}
+}
+
+// WithSliding 对所有key启用滑动过期, Get时按最近一次定时的时长重新定时
+// 没有过期时间或被暂停的key不受影响
+func WithSliding() Option {
+	return func(t *TimerStore) {
+		t.sliding = true
+	}
+}
+
+// WithReasonHandler 设置带触发原因的回调, 设置后代替构造时传入的Handler
+func WithReasonHandler(h ReasonHandler) Option {
+	return func(t *TimerStore) {
+		t.onEvent = h.EventHandler()
+	}
+}
+
+// WithEventHandler 设置以Event为参数的回调, 设置后代替构造时传入的Handler, 此时handler可以为nil
+func WithEventHandler(h EventHandler) Option {
+	return func(t *TimerStore) {
+		t.onEvent = h
+	}
+}
+
+// WithActionHandler 设置返回处理动作的到期回调, 设置后代替构造时传入的Handler
+// 返回的动作与确认租约在provider中原子地执行, 此时handler可以为nil
+// 读取次数用完时key已被删除, 仍按WithEventHandler等设置的回调执行, 都未设置时不执行回调
+func WithActionHandler(h ActionHandler) Option {
+	return func(t *TimerStore) {
+		t.onAction = h
+	}
+}
+
+// WithRetry 设置回调返回error时的重试策略, 默认不重试
+// 重试时key按等待时间在provider中重新定时并记录已失败的次数, 进程退出不会丢失
+// 读取次数用完触发的回调不重试
+func WithRetry(policy RetryPolicy) Option {
+	return func(t *TimerStore) {
+		t.retryPolicy = policy
+	}
+}
+
+// WithDeadLetter 回调重试用完仍失败时将key保存为死信, 可通过DeadLetters查看, ReplayDeadLetter重新写入
+// 默认直接丢弃
+func WithDeadLetter() Option {
+	return func(t *TimerStore) {
+		t.deadLetter = true
+	}
+}
+
+// WithVisibility 设置租约时长, 默认30秒
+// 到期的key在执行回调前被租用, 回调成功后确认, 进程在此期间退出时key在租约过期后重新到期并再次执行
+// 应大于回调的最长执行时间, 否则同一个key可能被重复执行
+func WithVisibility(d time.Duration) Option {
+	return func(t *TimerStore) {
+		t.visibility = d
+	}
+}
+
+// WithCatchUp 设置恢复到期处理时的策略, 默认为CatchUpFire
+func WithCatchUp(policy CatchUp) Option {
+	return func(t *TimerStore) {
+		t.catchUp = policy
+	}
+}
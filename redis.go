@@ -1,26 +1,35 @@
 package timerstore
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"dana-tech.com/wbw/logs"
+	"gopkg.in/redis.v3"
 )
 
 const (
-	nilMsg       = "redis: nil"
-	sortedSetKey = "timerstore"
+	nilMsg        = "redis: nil"
+	sortedSetKey  = "timerstore"
+	deadLetterKey = "deadletter"
+	manyBatch     = 100 // 批量操作时每个脚本处理的key个数
 )
 
-// 用三个数据模型来存储相关数据
-// 1. redis key=用户设置的key, value=entry的json序列化字符串, 供用户根据key快速获取value
-// 2. redis key=过期时间, value=1的key数组的json序列化字符串, 存储在此时间过期的所有key
-// 3. 一个Sorted set, 有序存储所有过期时间, 用于快速遍历取出过期时间集
+// 用三个数据模型来存储相关数据, 所有key都以{prefix}为hash tag, 在集群模式下落在同一个slot
+// 1. redis key={prefix}:key:用户设置的key, value=entry的json序列化字符串, 供用户根据key快速获取value
+// 2. redis key={prefix}:timer:过期时间(unix毫秒), value=1的key数组的json序列化字符串, 存储在此时间过期的所有key
+// 3. 一个Sorted set {prefix}:timerstore, 以过期时间(unix毫秒)为score有序存储所有2中的key, 用于快速遍历取出过期时间集
+// 另有一个hash {prefix}:deadletter 存储死信, field=用户设置的key, value=DeadLetter的json序列化字符串
+// 以及一个计数器 {prefix}:version, 为写入的entry分配单调递增的版本号
 
 type redisProvider struct {
 	prefix string
+	clock  Clock // 计算过期时间使用的时钟
 }
 
 // NewRedisProvider 对外提供构造redisProvider的方法
@@ -29,7 +38,7 @@ func NewRedisProvider(config *Config) (*redisProvider, error) {
 		return nil, err
 	}
 
-	r := new(redisProvider)
+	r := &redisProvider{clock: sysClock{}}
 
 	return r, nil
 }
@@ -38,222 +47,590 @@ func (r *redisProvider) SetPrefix(prefix string) {
 	r.prefix = prefix
 }
 
+func (r *redisProvider) SetClock(clock Clock) {
+	r.clock = clock
+}
+
 func (r *redisProvider) Get(key string) (string, bool, error) {
+	ent, ok, err := r.load(key)
+	if err != nil || !ok {
+		return "", false, err
+	}
+
+	return ent.Value, true, nil
+}
+
+func (r *redisProvider) Deadline(key string) (time.Time, bool, error) {
+	ent, ok, err := r.load(key)
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+
+	if ent.Lease != "" {
+		return fromUnixMilli(ent.Due), true, nil
+	}
+	if ent.Deadline == 0 {
+		return time.Time{}, true, nil
+	}
+	return fromUnixMilli(ent.Deadline), true, nil
+}
+
+func (r *redisProvider) Set(key string, val string, ttl int64) error {
+	return r.SetWithTTL(key, val, time.Duration(ttl)*time.Second)
+}
+
+func (r *redisProvider) SetWithTTL(key string, val string, ttl time.Duration) error {
+	return r.SetAt(key, val, r.clock.Now().Add(ttl))
+}
+
+func (r *redisProvider) SetAt(key string, val string, deadline time.Time) error {
+	_, err := r.set(key, newEntry(val, deadline, r.clock.Now()), "", 0)
+	return err
+}
+
+func (r *redisProvider) SetSliding(key string, val string, ttl time.Duration) error {
+	now := r.clock.Now()
+	ent := newEntry(val, now.Add(ttl), now)
+	ent.Sliding = true
+	_, err := r.set(key, ent, "", 0)
+	return err
+}
+
+func (r *redisProvider) SetMaxReads(key string, val string, ttl time.Duration, reads int64) error {
+	now := r.clock.Now()
+	ent := newEntry(val, now.Add(ttl), now)
+	ent.Reads = reads
+	_, err := r.set(key, ent, "", 0)
+	return err
+}
 
-	storeKey := fmt.Sprintf("%s:%s", r.prefix, key)
-	data, err := DaClient.Get(storeKey).Bytes()
+func (r *redisProvider) SetRecurring(key string, val string, spec string) (time.Time, error) {
+	sched, err := ParseSchedule(spec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := r.clock.Now()
+	first := sched.Next(now)
+	if first.IsZero() {
+		return time.Time{}, invalidSpec(spec)
+	}
+
+	ent := newEntry(val, first, now)
+	ent.Spec = spec
+	if _, err := r.set(key, ent, "", 0); err != nil {
+		return time.Time{}, err
+	}
+	return first, nil
+}
+
+func (r *redisProvider) SetNX(key string, val string, ttl time.Duration) (bool, error) {
+	now := r.clock.Now()
+	return r.set(key, newEntry(val, now.Add(ttl), now), "NX", 0)
+}
+
+func (r *redisProvider) SetXX(key string, val string, ttl time.Duration) (bool, error) {
+	now := r.clock.Now()
+	return r.set(key, newEntry(val, now.Add(ttl), now), "XX", 0)
+}
+
+func (r *redisProvider) CompareAndSet(key string, val string, ttl time.Duration, version uint64) (bool, error) {
+	now := r.clock.Now()
+	return r.set(key, newEntry(val, now.Add(ttl), now), "CAS", version)
+}
+
+func (r *redisProvider) Expire(key string, ttl time.Duration) (bool, error) {
+	return r.ExpireAt(key, r.clock.Now().Add(ttl))
+}
+
+func (r *redisProvider) ExpireAt(key string, deadline time.Time) (bool, error) {
+	due := unixMilli(deadline)
+	ttl := remaining(due, r.clock.Now())
+	return r.eval(expireScript, key, strconv.FormatInt(due, 10), strconv.FormatInt(ttl, 10))
+}
+
+// Touch 先读取entry, 只有需要扣减读取次数或重新定时时才执行脚本, 普通key的读取只有一次GET
+func (r *redisProvider) Touch(key string, always bool) (string, uint64, bool, bool, error) {
+	ent, ok, err := r.load(key)
+	if err != nil || !ok {
+		return "", 0, false, false, err
+	}
+	if ent.Reads == 0 && !slides(ent, always) {
+		return ent.Value, ent.Version, true, false, nil
+	}
+
+	return r.touch(key, always)
+}
+
+// touch 执行touchScript扣减读取次数并重新定时
+func (r *redisProvider) touch(key string, always bool) (string, uint64, bool, bool, error) {
+	keys := []string{r.storeKey(key), r.setKey()}
+	flag := "0"
+	if always {
+		flag = "1"
+	}
+	args := []string{r.tag(), strconv.FormatInt(unixMilli(r.clock.Now()), 10), flag}
+	res, err := DaClient.Eval(touchScript, keys, args).Result()
 	if err != nil {
 		if err.Error() == nilMsg {
-			return "", false, nil
+			return "", 0, false, false, nil
 		}
-		return "", false, err
+		return "", 0, false, false, err
 	}
 
-	var ent entry
-	if err := json.Unmarshal(data, &ent); err != nil {
-		return "", false, err
+	reply, _ := res.([]interface{})
+	if len(reply) != 3 {
+		return "", 0, false, false, fmt.Errorf("unexpected touch reply: %v", res)
 	}
+	exhausted, _ := reply[0].(int64)
+	val, _ := reply[1].(string)
+	version, _ := reply[2].(int64)
+	return val, uint64(version), true, exhausted == 1, nil
+}
 
-	return ent.Value, true, nil
+func (r *redisProvider) Persist(key string) (bool, error) {
+	return r.eval(persistScript, key)
 }
 
-func (r *redisProvider) Set(key string, val string, ttl int64) error {
+func (r *redisProvider) Pause(key string) (bool, error) {
+	return r.eval(pauseScript, key, strconv.FormatInt(unixMilli(r.clock.Now()), 10))
+}
 
-	due := time.Now().Unix() + ttl
-	timerKey := fmt.Sprintf("%s:%d", r.prefix, due)
-	storeKey := fmt.Sprintf("%s:%s", r.prefix, key)
-	setKey := fmt.Sprintf("%s:%s", r.prefix, sortedSetKey)
+func (r *redisProvider) Resume(key string) (bool, error) {
+	return r.eval(resumeScript, key, strconv.FormatInt(unixMilli(r.clock.Now()), 10))
+}
 
-	item := entry{
-		TimerKey: timerKey,
-		Value:    val,
+func (r *redisProvider) Del(key string) error {
+	_, err := r.eval(delScript, key)
+	return err
+}
+
+func (r *redisProvider) Take(key string) (string, bool, error) {
+	keys := []string{r.storeKey(key), r.setKey()}
+	args := []string{r.tag(), strconv.FormatInt(unixMilli(r.clock.Now()), 10)}
+	res, err := DaClient.Eval(takeScript, keys, args).Result()
+	if err != nil {
+		if err.Error() == nilMsg {
+			return "", false, nil
+		}
+		return "", false, err
 	}
 
-	data, _ := json.Marshal(item)
+	val, _ := res.(string)
+	return val, true, nil
+}
 
-	err := DaClient.Get(storeKey).Err()
-	if err != nil && err.Error() != nilMsg {
-		return err
+func (r *redisProvider) Claim(now time.Time, limit int, visibility time.Duration) ([]Event, error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	args := []string{
+		r.tag(),
+		strconv.FormatInt(unixMilli(now), 10),
+		strconv.Itoa(limit),
+		strconv.FormatInt(visibility.Nanoseconds()/int64(time.Millisecond), 10),
+		hex.EncodeToString(b),
+	}
+	res, err := DaClient.Eval(claimScript, []string{r.setKey()}, args).Result()
+	if err != nil {
+		if err.Error() == nilMsg {
+			return nil, nil
+		}
+		return nil, err
 	}
-	if err == nil {
-		// 有旧值存在, 需要删除旧值
-		if err = r.Del(key); err != nil {
-			return err
+
+	reply, _ := res.([]interface{})
+	claimed := make([]Event, 0, len(reply))
+	for _, v := range reply {
+		item, _ := v.([]interface{})
+		if len(item) != 6 {
+			return nil, fmt.Errorf("unexpected claim reply: %v", v)
 		}
+		key, _ := item[0].(string)
+		val, _ := item[1].(string)
+		due, _ := item[2].(int64)
+		attempt, _ := item[3].(int64)
+		id, _ := item[4].(string)
+		spec, _ := item[5].(string)
+		claimed = append(claimed, Event{ID: id, Key: key, Value: val, Deadline: fromUnixMilli(due), Attempt: int(attempt), Spec: spec})
 	}
 
-	var storeKeys []string
-	keysBytes, err := DaClient.Get(timerKey).Bytes()
-	if err != nil && err.Error() != nilMsg {
-		return err
+	return claimed, nil
+}
+
+// Ack 先读取entry在本地计算周期key的下一次触发时间, 再由脚本原子地检查租约并执行ops或重新定时, 删除
+func (r *redisProvider) Ack(id string, ops []TxnOp) (bool, error) {
+	key := leaseKey(id)
+	ent, ok, err := r.load(key)
+	if err != nil || !ok || ent.Lease != id {
+		return false, err
 	}
-	if err == nil {
-		if err = json.Unmarshal(keysBytes, &storeKeys); err != nil {
-			return err
+
+	now := r.clock.Now()
+	var next int64
+	if ent.Spec != "" && len(ops) == 0 {
+		if next, err = nextFire(ent.Spec, ent.Due, now); err != nil {
+			return false, err
 		}
 	}
 
-	storeKeys = append(storeKeys, storeKey)
-	keysBytes, _ = json.Marshal(storeKeys)
+	list := [][]interface{}{}
+	for _, op := range ops {
+		due := unixMilli(now.Add(op.TTL))
+		list = append(list, []interface{}{op.Type, op.Value, due, remaining(due, now)})
+	}
+	data, _ := json.Marshal(list)
+
+	return r.eval(ackScript, key, id, strconv.FormatInt(next, 10), ent.Spec, strconv.FormatInt(unixMilli(now), 10), string(data))
+}
+
+func (r *redisProvider) Nack(id string, deadline time.Time) (bool, error) {
+	return r.eval(nackScript, leaseKey(id), id, strconv.FormatInt(unixMilli(deadline), 10))
+}
 
-	if err = DaClient.Set(storeKey, string(data), time.Duration(0)).Err(); err != nil {
+func (r *redisProvider) AddDeadLetter(dl DeadLetter) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
 		return err
 	}
+	return DaClient.HMSetMap(r.deadKey(), map[string]string{dl.Key: string(data)}).Err()
+}
 
-	if err = DaClient.Set(timerKey, string(keysBytes), time.Duration(0)).Err(); err != nil {
-		return err
+func (r *redisProvider) DeadLetters() ([]DeadLetter, error) {
+	all, err := DaClient.HGetAllMap(r.deadKey()).Result()
+	if err != nil {
+		if err.Error() == nilMsg {
+			return []DeadLetter{}, nil
+		}
+		return nil, err
 	}
 
-	if err = DaClient.ZAdd(setKey, NewZ(due, timerKey)).Err(); err != nil {
-		if len(storeKeys) == 1 {
-			// 重复添加相同元素,可能会导致redis返回错误
-			return err
+	letters := make([]DeadLetter, 0, len(all))
+	for _, data := range all {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(data), &dl); err != nil {
+			return nil, err
 		}
-		logs.Logger.Debugf("zadd sorted set key: %s value: %s, error: %v", setKey, timerKey, err.Error())
+		letters = append(letters, dl)
 	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].Key < letters[j].Key
+	})
 
-	return nil
+	return letters, nil
 }
 
-func (r *redisProvider) Del(key string) error {
-	storeKey := fmt.Sprintf("%s:%s", r.prefix, key)
-	data, err := DaClient.Get(storeKey).Bytes()
-	if err != nil && err.Error() != nilMsg {
-		return err
+func (r *redisProvider) ReplayDeadLetter(key string, deadline time.Time) (bool, error) {
+	keys := []string{r.storeKey(key), r.setKey(), r.deadKey()}
+	due := unixMilli(deadline)
+	args := []string{r.tag(), key, strconv.FormatInt(due, 10), strconv.FormatInt(remaining(due, r.clock.Now()), 10)}
+	res, err := DaClient.Eval(replayScript, keys, args).Result()
+	if err != nil {
+		return false, err
 	}
-	if err == nil {
-		var ent entry
-		if err = json.Unmarshal(data, &ent); err != nil {
-			return err
-		}
 
-		storeKeysBytes, err := DaClient.Get(ent.TimerKey).Bytes()
+	n, _ := res.(int64)
+	return n == 1, nil
+}
+
+func (r *redisProvider) PurgeDeadLetters(keys []string) (int, error) {
+	res, err := DaClient.Eval(purgeScript, []string{r.deadKey()}, keys).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	n, _ := res.(int64)
+	return int(n), nil
+}
+
+// GetMany 通过pipeline读取, 只对需要扣减读取次数或重新定时的key执行touchScript
+func (r *redisProvider) GetMany(keys []string, always bool) []GetResult {
+	results := make([]GetResult, len(keys))
+
+	pipe, err := NewPipeline()
+	if err != nil {
+		return fillResults(results, err)
+	}
+	defer pipe.Close()
+
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(r.storeKey(key))
+	}
+	pipe.Exec()
+
+	for i, cmd := range cmds {
+		data, err := cmd.Bytes()
 		if err != nil {
-			return err
+			if err.Error() != nilMsg {
+				results[i].Err = err
+			}
+			continue
 		}
-		var storeKeys []string
-		if err = json.Unmarshal(storeKeysBytes, &storeKeys); err != nil {
-			return err
+		var ent entry
+		if err = json.Unmarshal(data, &ent); err != nil {
+			results[i].Err = err
+			continue
 		}
-		storeKeys = delItem(storeKeys, storeKey)
-
-		if len(storeKeys) == 0 {
-			if err = DaClient.Del(ent.TimerKey).Err(); err != nil {
-				return err
-			}
-		} else {
-			storeKeysBytes, _ = json.Marshal(storeKeys)
-			if err = DaClient.Set(ent.TimerKey, string(storeKeysBytes), time.Duration(0)).Err(); err != nil {
-				return err
-			}
+		if ent.Reads != 0 || slides(ent, always) {
+			// 需要扣减读取次数或重新定时的key逐个执行脚本
+			results[i].Value, _, results[i].OK, results[i].Exhausted, results[i].Err = r.touch(keys[i], always)
+			continue
 		}
+		results[i].Value = ent.Value
+		results[i].OK = true
+	}
+
+	return results
+}
+
+func (r *redisProvider) SetMany(items []Item) []error {
+	now := r.clock.Now()
+	keys := make([]string, len(items))
+	args := make([]string, 0, 3*len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+		due := unixMilli(now.Add(item.TTL))
+		args = append(args, item.Value, strconv.FormatInt(due, 10), strconv.FormatInt(remaining(due, now), 10))
+	}
+
+	return r.evalMany(setManyScript, keys, args, 3)
+}
+
+func (r *redisProvider) DelMany(keys []string) []error {
+	return r.evalMany(delManyScript, keys, nil, 0)
+}
 
-		if err = DaClient.Del(storeKey).Err(); err != nil {
-			return err
+func (r *redisProvider) Commit(conds []TxnCond, ops []TxnOp) (bool, error) {
+	keys := []string{r.setKey()}
+	index := make(map[string]int)
+	keyIndex := func(key string) int {
+		if i, ok := index[key]; ok {
+			return i
 		}
+		keys = append(keys, r.storeKey(key))
+		index[key] = len(keys)
+		return len(keys)
+	}
+
+	txn := map[string][][]interface{}{
+		"Conds": {},
+		"Ops":   {},
 	}
+	for _, cond := range conds {
+		txn["Conds"] = append(txn["Conds"], []interface{}{keyIndex(cond.Key), cond.Version})
+	}
+	now := r.clock.Now()
+	for _, op := range ops {
+		due := unixMilli(now.Add(op.TTL))
+		txn["Ops"] = append(txn["Ops"], []interface{}{op.Type, keyIndex(op.Key), op.Value, due, remaining(due, now)})
+	}
+	data, _ := json.Marshal(txn)
 
-	return nil
+	res, err := DaClient.Eval(txnScript, keys, []string{r.tag(), string(data)}).Result()
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := res.(int64)
+	return n == 1, nil
 }
 
-func (r *redisProvider) Before(t int64) (map[string]string, bool, error) {
+// IncrBy 在lua中以double计算, 超过2^53的值会丢失精度
+func (r *redisProvider) IncrBy(key string, delta int64, ttlIfNew time.Duration) (int64, bool, error) {
+	keys := []string{r.storeKey(key), r.setKey()}
+	now := r.clock.Now()
+	due := unixMilli(now.Add(ttlIfNew))
+	args := []string{r.tag(), strconv.FormatInt(delta, 10), strconv.FormatInt(due, 10),
+		strconv.FormatInt(remaining(due, now), 10), strconv.FormatInt(unixMilli(now), 10)}
+	res, err := DaClient.Eval(incrScript, keys, args).Result()
+	if err != nil {
+		if err.Error() == nilMsg {
+			return 0, false, errNotInteger
+		}
+		return 0, false, err
+	}
 
-	due := make(map[string]string)
-	timerKey := fmt.Sprintf("%s:%d", r.prefix, t)
-	setKey := fmt.Sprintf("%s:%s", r.prefix, sortedSetKey)
+	reply, _ := res.([]interface{})
+	if len(reply) != 2 {
+		return 0, false, fmt.Errorf("unexpected incr reply: %v", res)
+	}
+	created, _ := reply[0].(int64)
+	val, _ := reply[1].(string)
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return n, created == 1, nil
+}
 
-	var removes []string
-	var isOver = false
-	for !isOver {
+func (r *redisProvider) Next() (time.Time, bool, error) {
+	setKey := r.setKey()
 
-		timerKeys, err := DaClient.ZRange(setKey, 0, 10).Result()
-		if err != nil {
-			if err.Error() == nilMsg {
-				break
-			}
-			return nil, false, err
+	first, err := DaClient.ZRangeWithScores(setKey, 0, 0).Result()
+	if err != nil {
+		if err.Error() == nilMsg {
+			return time.Time{}, false, nil
 		}
+		return time.Time{}, false, err
+	}
+	if len(first) == 0 {
+		return time.Time{}, false, nil
+	}
+
+	return fromUnixMilli(int64(first[0].Score)), true, nil
+}
 
-		if len(timerKeys) < 100 {
-			isOver = true
+// Migrate 将旧版本写入的数据迁移到当前的存储结构, 返回迁移的key个数, 升级后执行一次即可
+// 旧结构为 prefix:key, prefix:过期时间(unix秒) 和以秒为score的sorted set prefix:timerstore
+// 新结构中已存在的key不会被覆盖, 迁移完的旧数据被删除, 中断后可重复执行
+func (r *redisProvider) Migrate() (int, error) {
+	legacySet := r.prefix + ":" + sortedSetKey
+	n := 0
+	for {
+		timers, err := DaClient.ZRangeWithScores(legacySet, 0, manyBatch-1).Result()
+		if err != nil && err.Error() != nilMsg {
+			return n, err
+		}
+		if len(timers) == 0 {
+			return n, nil
 		}
 
-		for _, k := range timerKeys {
-			if k <= timerKey {
-				storeKeysBytes, err := DaClient.Get(k).Bytes()
-				if err != nil && err.Error() != nilMsg {
-					return nil, false, err
+		for _, z := range timers {
+			timerKey, _ := z.Member.(string)
+			deadline := time.Unix(int64(z.Score), 0)
+
+			storeKeysBytes, err := DaClient.Get(timerKey).Bytes()
+			if err != nil && err.Error() != nilMsg {
+				return n, err
+			}
+			var storeKeys []string
+			if err == nil {
+				if err = json.Unmarshal(storeKeysBytes, &storeKeys); err != nil {
+					return n, err
 				}
-				if err == nil {
-					var storeKeys []string
-					if err = json.Unmarshal(storeKeysBytes, &storeKeys); err != nil {
-						return nil, false, err
-					}
-					for _, storeKey := range storeKeys {
-						key := retrieveKey(storeKey)
-						data, has, err := r.Get(key)
-						if err != nil {
-							return nil, false, err
-						}
-						if has {
-							due[key] = data
-						}
+			}
+
+			for _, storeKey := range storeKeys {
+				data, err := DaClient.Get(storeKey).Bytes()
+				if err != nil {
+					if err.Error() == nilMsg {
+						continue
 					}
+					return n, err
+				}
+				var ent entry
+				if err = json.Unmarshal(data, &ent); err != nil {
+					return n, err
 				}
 
-				removes = append(removes, k)
-			} else {
-				isOver = true
-				break
+				key := strings.TrimPrefix(storeKey, r.prefix+":")
+				ok, err := r.set(key, newEntry(ent.Value, deadline, r.clock.Now()), "NX", 0)
+				if err != nil {
+					return n, err
+				}
+				if ok {
+					n++
+				}
+				if err = DaClient.Del(storeKey).Err(); err != nil {
+					return n, err
+				}
 			}
-		}
 
-		if len(removes) > 0 {
-			if err := DaClient.ZRem(setKey, removes...).Err(); err != nil {
-				return nil, false, err
+			if err := DaClient.Del(timerKey).Err(); err != nil {
+				return n, err
+			}
+			if err := DaClient.ZRem(legacySet, timerKey).Err(); err != nil {
+				return n, err
 			}
 		}
 	}
+}
+
+// tag 返回所有redis key共用的hash tag
+func (r *redisProvider) tag() string {
+	return "{" + r.prefix + "}"
+}
+
+func (r *redisProvider) storeKey(key string) string {
+	return r.tag() + ":key:" + key
+}
+
+func (r *redisProvider) setKey() string {
+	return r.tag() + ":" + sortedSetKey
+}
+
+func (r *redisProvider) deadKey() string {
+	return r.tag() + ":" + deadLetterKey
+}
+
+// set 以ent替换key原有的entry, mode为写入条件, 为CAS时version为期望的版本号
+func (r *redisProvider) set(key string, ent entry, mode string, version uint64) (bool, error) {
+	data, err := json.Marshal(ent)
+	if err != nil {
+		return false, err
+	}
+	return r.eval(setScript, key, string(data), mode, strconv.FormatUint(version, 10))
+}
 
-	var has = true
-	if len(due) == 0 {
-		has = false
+// eval 对key执行脚本, 返回脚本是否执行成功
+func (r *redisProvider) eval(script string, key string, args ...string) (bool, error) {
+	keys := []string{r.storeKey(key), r.setKey()}
+	res, err := DaClient.Eval(script, keys, append([]string{r.tag()}, args...)).Result()
+	if err != nil {
+		return false, err
 	}
 
-	return due, has, nil
+	n, _ := res.(int64)
+	return n == 1, nil
 }
 
-func delItem(origin []string, del string) (trimed []string) {
-	if len(origin) == 0 {
-		return origin
+// evalMany 将keys按manyBatch分组, 每组执行一次批量脚本, 所有分组通过一个pipeline发送
+// 每个key对应args中的n个参数, 返回每个key的执行结果
+func (r *redisProvider) evalMany(script string, keys []string, args []string, n int) []error {
+	pipe, err := NewPipeline()
+	if err != nil {
+		return fillErrors(len(keys), err)
 	}
+	defer pipe.Close()
 
-	var isFound = false
-	var index = 0
-	for i, item := range origin {
-		if item == del {
-			isFound = true
-			index = i
-			break
+	var cmds []*redis.Cmd
+	for start := 0; start < len(keys); start += manyBatch {
+		end := start + manyBatch
+		if end > len(keys) {
+			end = len(keys)
 		}
-	}
 
-	trimed = origin
-	if isFound {
-		if index == len(origin)-1 {
-			trimed = origin[:index]
-		} else {
-			trimed = append(origin[:index], origin[index+1:]...)
+		batchKeys := []string{r.setKey()}
+		for _, key := range keys[start:end] {
+			batchKeys = append(batchKeys, r.storeKey(key))
 		}
+		batchArgs := append([]string{r.tag()}, args[start*n:end*n]...)
+		cmds = append(cmds, pipe.Eval(script, batchKeys, batchArgs))
 	}
+	pipe.Exec()
 
-	return
+	errs := make([]error, len(keys))
+	for i := range errs {
+		errs[i] = cmds[i/manyBatch].Err()
+	}
+
+	return errs
 }
 
-func retrieveKey(after string) (origin string) {
-	q := strings.Split(after, ":")
-	if len(q) < 2 {
-		return ""
+// load 读取key对应的entry
+func (r *redisProvider) load(key string) (entry, bool, error) {
+	var ent entry
+
+	data, err := DaClient.Get(r.storeKey(key)).Bytes()
+	if err != nil {
+		if err.Error() == nilMsg {
+			return ent, false, nil
+		}
+		return ent, false, err
 	}
-	return q[1]
+
+	if err := json.Unmarshal(data, &ent); err != nil {
+		return ent, false, err
+	}
+
+	return ent, true, nil
 }
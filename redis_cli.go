@@ -28,7 +28,17 @@ type DClient interface {
 	Del(keys ...string) *redis.IntCmd
 	ZAdd(key string, members ...redis.Z) *redis.IntCmd
 	ZRange(key string, start, stop int64) *redis.StringSliceCmd
+	ZRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
 	ZRem(key string, members ...string) *redis.IntCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+}
+
+// DPipeline 是redis 集群或单机模式的pipeline的抽象接口
+type DPipeline interface {
+	Get(string) *redis.StringCmd
+	Eval(script string, keys []string, args []string) *redis.Cmd
+	Exec() ([]redis.Cmder, error)
+	Close() error
 }
 
 // DaClient 全局共用redis client
@@ -60,6 +70,17 @@ func NewRedisClient(config *Config) (client DClient, err error) {
 	return
 }
 
+// NewPipeline 根据DaClient的模式创建pipeline
+func NewPipeline() (DPipeline, error) {
+	switch c := DaClient.(type) {
+	case *redis.Client:
+		return c.Pipeline(), nil
+	case *redis.ClusterClient:
+		return c.Pipeline(), nil
+	}
+	return nil, fmt.Errorf("Redis pipeline not supported by %T", DaClient)
+}
+
 // InitRedis 初始化DaClient
 func InitRedis(config *Config) (err error) {
 	DaClient, err = NewRedisClient(config)
@@ -0,0 +1,423 @@
+package timerstore
+
+// redisProvider的写操作都通过lua脚本执行, 保证entry, timer key与sorted set的修改是原子的
+// 除批量脚本外, 所有脚本的KEYS[1]为用户key对应的redis key, KEYS[2]为sorted set, ARGV[1]为hash tag
+// 脚本返回1表示执行成功, 0表示条件不满足(key不存在等)
+
+// luaLib 各脚本共用的函数
+const luaLib = `
+local function load(storeKey)
+	local raw = redis.call('GET', storeKey)
+	if not raw then
+		return nil
+	end
+	return cjson.decode(raw)
+end
+
+local function save(storeKey, ent)
+	redis.call('SET', storeKey, cjson.encode(ent))
+end
+
+local function unlink(storeKey, setKey, ent)
+	local timerKey = ent['TimerKey']
+	if timerKey == nil or timerKey == '' then
+		return
+	end
+	local raw = redis.call('GET', timerKey)
+	if raw then
+		local keys = cjson.decode(raw)
+		for i = #keys, 1, -1 do
+			if keys[i] == storeKey then
+				table.remove(keys, i)
+				break
+			end
+		end
+		if #keys > 0 then
+			redis.call('SET', timerKey, cjson.encode(keys))
+			ent['TimerKey'] = ''
+			return
+		end
+		redis.call('DEL', timerKey)
+	end
+	redis.call('ZREM', setKey, timerKey)
+	ent['TimerKey'] = ''
+end
+
+local function link(storeKey, setKey, tag, ent)
+	local due = string.format('%d', ent['Deadline'])
+	local timerKey = tag .. ':timer:' .. due
+	local keys = {}
+	local raw = redis.call('GET', timerKey)
+	if raw then
+		keys = cjson.decode(raw)
+	end
+	table.insert(keys, storeKey)
+	redis.call('SET', timerKey, cjson.encode(keys))
+	redis.call('ZADD', setKey, due, timerKey)
+	ent['TimerKey'] = timerKey
+end
+
+local function version(ent)
+	if not ent then
+		return 0
+	end
+	return ent['Version'] or 0
+end
+
+-- nextVersion 分配store内单调递增的版本号, key被删除后也不会重复使用
+local function nextVersion(tag)
+	return redis.call('INCR', tag .. ':version')
+end
+
+-- set 以新的entry替换原entry并定时, new中未设置的字段取默认值
+local function set(storeKey, setKey, tag, ent, new)
+	if ent then
+		unlink(storeKey, setKey, ent)
+	end
+	new['TimerKey'] = ''
+	new['Paused'] = false
+	new['Remaining'] = 0
+	new['Version'] = nextVersion(tag)
+	link(storeKey, setKey, tag, new)
+	save(storeKey, new)
+end
+
+local function del(storeKey, setKey, ent)
+	unlink(storeKey, setKey, ent)
+	redis.call('DEL', storeKey)
+end
+
+-- release 作废key的租约, 回调执行期间key被修改时调用, 之后的Ack不再影响key
+local function release(ent)
+	ent['Lease'] = ''
+	ent['Due'] = 0
+	ent['Attempt'] = 0
+end
+
+local function persist(storeKey, setKey, ent)
+	unlink(storeKey, setKey, ent)
+	release(ent)
+	ent['Deadline'] = 0
+	ent['Paused'] = false
+	ent['Remaining'] = 0
+	save(storeKey, ent)
+end
+
+local function expire(storeKey, setKey, tag, ent, due, ttl)
+	unlink(storeKey, setKey, ent)
+	ent['Deadline'] = due
+	ent['TTL'] = ttl
+	ent['Paused'] = false
+	ent['Remaining'] = 0
+	link(storeKey, setKey, tag, ent)
+	save(storeKey, ent)
+end
+
+-- exec 执行事务中的一个操作, kind为0写入, 1删除, 2重新定时, 3取消定时
+local function exec(storeKey, setKey, tag, kind, value, due, ttl)
+	local ent = load(storeKey)
+	if kind == 0 then
+		set(storeKey, setKey, tag, ent, {Value = value, Deadline = due, TTL = ttl})
+	elseif ent and kind == 1 then
+		del(storeKey, setKey, ent)
+	elseif ent and kind == 2 then
+		release(ent)
+		expire(storeKey, setKey, tag, ent, due, ttl)
+	elseif ent and kind == 3 then
+		persist(storeKey, setKey, ent)
+	end
+end
+`
+
+// setScript 写入value并定时, 分配新的版本号
+// ARGV[2]为新entry的json, ARGV[3]为写入条件, 条件为CAS时ARGV[4]为期望的版本号
+const setScript = luaLib + `
+local ent = load(KEYS[1])
+if ARGV[3] == 'NX' and ent then
+	return 0
+end
+if ARGV[3] == 'XX' and not ent then
+	return 0
+end
+if ARGV[3] == 'CAS' and version(ent) ~= tonumber(ARGV[4]) then
+	return 0
+end
+set(KEYS[1], KEYS[2], ARGV[1], ent, cjson.decode(ARGV[2]))
+return 1
+`
+
+// setManyScript 批量写入, KEYS[1]为sorted set, KEYS[i+1]为第i个key
+// ARGV[3i-1], ARGV[3i]和ARGV[3i+1]为第i个key的value, 过期时间和ttl
+const setManyScript = luaLib + `
+for i = 2, #KEYS do
+	local n = 3 * i - 4
+	set(KEYS[i], KEYS[1], ARGV[1], load(KEYS[i]), {Value = ARGV[n], Deadline = tonumber(ARGV[n + 1]), TTL = tonumber(ARGV[n + 2])})
+end
+return 1
+`
+
+// delScript 删除key及其定时
+const delScript = luaLib + `
+local ent = load(KEYS[1])
+if not ent then
+	return 0
+end
+del(KEYS[1], KEYS[2], ent)
+return 1
+`
+
+// delManyScript 批量删除, KEYS[1]为sorted set, KEYS[i+1]为第i个key
+const delManyScript = luaLib + `
+for i = 2, #KEYS do
+	local ent = load(KEYS[i])
+	if ent then
+		del(KEYS[i], KEYS[1], ent)
+	end
+end
+return 1
+`
+
+// takeScript 删除key及其定时, 返回删除前的value, ARGV[2]为当前时间
+// key不存在或回调正在执行(租约未过期)时返回nil
+const takeScript = luaLib + `
+local ent = load(KEYS[1])
+if not ent then
+	return false
+end
+if (ent['Lease'] or '') ~= '' and ent['Deadline'] > tonumber(ARGV[2]) then
+	return false
+end
+del(KEYS[1], KEYS[2], ent)
+return ent['Value']
+`
+
+// claimScript 租用到期的key, KEYS[1]为sorted set, ARGV[2]为当前时间, ARGV[3]为最多租用的个数
+// ARGV[4]为租约时长, ARGV[5]为租约id前缀; 租用的key以租约过期时间重新定时, 未Ack时会再次到期
+// 返回{{key, value, 原计划触发时间, 租用次数, 租约id, 周期规则}...}
+const claimScript = luaLib + `
+local now = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local expiry = now + tonumber(ARGV[4])
+local prefix = ARGV[1] .. ':key:'
+local claimed = {}
+local timerKeys = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[2], 'LIMIT', 0, limit)
+for _, timerKey in ipairs(timerKeys) do
+	local raw = redis.call('GET', timerKey)
+	if not raw then
+		redis.call('ZREM', KEYS[1], timerKey)
+	else
+		for _, storeKey in ipairs(cjson.decode(raw)) do
+			if #claimed >= limit then
+				break
+			end
+			local ent = load(storeKey)
+			if ent and ent['TimerKey'] == timerKey then
+				if (ent['Due'] or 0) == 0 then
+					ent['Due'] = ent['Deadline']
+				end
+				ent['Attempt'] = (ent['Attempt'] or 0) + 1
+				local key = string.sub(storeKey, #prefix + 1)
+				ent['Lease'] = ARGV[5] .. '-' .. (#claimed + 1) .. ':' .. key
+				expire(storeKey, KEYS[1], ARGV[1], ent, expiry, ent['TTL'] or 0)
+				table.insert(claimed, {key, ent['Value'], ent['Due'], ent['Attempt'], ent['Lease'], ent['Spec'] or ''})
+			else
+				-- entry已不在此定时上, 清除残留
+				unlink(storeKey, KEYS[1], {TimerKey = timerKey})
+			end
+		end
+	end
+	if #claimed >= limit then
+		break
+	end
+end
+return claimed
+`
+
+// ackScript 确认租约, ARGV[2]为租约id, ARGV[5]为当前时间
+// ARGV[6]为json: [[操作类型, value, 过期时间, ttl]...], 非空时对key依次执行这些操作
+// 为空时周期key按ARGV[4]的规则计算出的ARGV[3]重新定时, ARGV[3]为0或规则已被修改时按一次性key删除
+// 租约已失效时返回0且不执行任何操作
+const ackScript = luaLib + `
+local ent = load(KEYS[1])
+if not ent or ent['Lease'] ~= ARGV[2] then
+	return 0
+end
+release(ent)
+local ops = cjson.decode(ARGV[6])
+if #ops > 0 then
+	save(KEYS[1], ent)
+	for _, op in ipairs(ops) do
+		exec(KEYS[1], KEYS[2], ARGV[1], op[1], op[2], op[3], op[4])
+	end
+	return 1
+end
+local spec = ent['Spec'] or ''
+local due = tonumber(ARGV[3])
+if spec ~= '' and spec == ARGV[4] and due > 0 then
+	expire(KEYS[1], KEYS[2], ARGV[1], ent, due, due - tonumber(ARGV[5]))
+	return 1
+end
+del(KEYS[1], KEYS[2], ent)
+return 1
+`
+
+// nackScript 放弃租约, key在ARGV[3]重新到期, ARGV[2]为租约id, 租约已失效时返回0
+const nackScript = luaLib + `
+local ent = load(KEYS[1])
+if not ent or ent['Lease'] ~= ARGV[2] then
+	return 0
+end
+ent['Lease'] = ''
+expire(KEYS[1], KEYS[2], ARGV[1], ent, tonumber(ARGV[3]), ent['TTL'] or 0)
+return 1
+`
+
+// replayScript 将死信重新写入为key并移除死信, KEYS[3]为死信hash, ARGV[2]为key, ARGV[3]为过期时间, ARGV[4]为ttl
+// 周期key保留死信中的定时规则, 死信不存在或key已存在时返回0
+const replayScript = luaLib + `
+local raw = redis.call('HGET', KEYS[3], ARGV[2])
+if not raw or load(KEYS[1]) then
+	return 0
+end
+local dl = cjson.decode(raw)
+set(KEYS[1], KEYS[2], ARGV[1], nil, {Value = dl['Value'], Deadline = tonumber(ARGV[3]), TTL = tonumber(ARGV[4]), Spec = dl['Spec']})
+redis.call('HDEL', KEYS[3], ARGV[2])
+return 1
+`
+
+// purgeScript 删除死信, KEYS[1]为死信hash, ARGV为要删除的key, 没有ARGV时删除全部, 返回删除的个数
+const purgeScript = `
+if #ARGV == 0 then
+	local n = redis.call('HLEN', KEYS[1])
+	redis.call('DEL', KEYS[1])
+	return n
+end
+return redis.call('HDEL', KEYS[1], unpack(ARGV))
+`
+
+// incrScript 按整数加上ARGV[2], key不存在或回调正在执行时以ARGV[2]为初始值, 在ARGV[3]过期, ttl为ARGV[4]
+// ARGV[5]为当前时间
+// 返回{是否新写入, 相加后的值}, value不是整数时返回nil
+const incrScript = luaLib + `
+local ent = load(KEYS[1])
+local delta = tonumber(ARGV[2])
+if ent and (ent['Lease'] or '') ~= '' and ent['Deadline'] > tonumber(ARGV[5]) then
+	-- 回调执行中的key的计数窗口已结束, 开始新的窗口
+	set(KEYS[1], KEYS[2], ARGV[1], ent, {Value = ARGV[2], Deadline = tonumber(ARGV[3]), TTL = tonumber(ARGV[4])})
+	return {1, ARGV[2]}
+end
+if not ent then
+	set(KEYS[1], KEYS[2], ARGV[1], nil, {Value = ARGV[2], Deadline = tonumber(ARGV[3]), TTL = tonumber(ARGV[4])})
+	return {1, ARGV[2]}
+end
+if not string.match(ent['Value'], '^-?%d+$') then
+	return false
+end
+local n = string.format('%d', tonumber(ent['Value']) + delta)
+release(ent)
+ent['Value'] = n
+ent['Version'] = nextVersion(ARGV[1])
+save(KEYS[1], ent)
+return {0, n}
+`
+
+// expireScript 修改过期时间, ARGV[2]为过期时间, ARGV[3]为ttl
+const expireScript = luaLib + `
+local ent = load(KEYS[1])
+if not ent then
+	return 0
+end
+release(ent)
+expire(KEYS[1], KEYS[2], ARGV[1], ent, tonumber(ARGV[2]), tonumber(ARGV[3]))
+return 1
+`
+
+// touchScript 读取value, 扣减剩余读取次数, 用完时删除key
+// 滑动过期的key按原始ttl重新定时, 回调执行中的key除外, ARGV[2]为当前时间, ARGV[3]为1时所有key都重新定时
+// 返回{读取次数是否用完, value, 版本号}, key不存在时返回nil
+const touchScript = luaLib + `
+local ent = load(KEYS[1])
+if not ent then
+	return false
+end
+local reads = ent['Reads'] or 0
+if reads == 1 then
+	del(KEYS[1], KEYS[2], ent)
+	return {1, ent['Value'], version(ent)}
+end
+if reads > 1 then
+	ent['Reads'] = reads - 1
+end
+local ttl = ent['TTL'] or 0
+if (ARGV[3] == '1' or ent['Sliding']) and ent['Deadline'] ~= 0 and ttl > 0 and (ent['Lease'] or '') == '' then
+	expire(KEYS[1], KEYS[2], ARGV[1], ent, tonumber(ARGV[2]) + ttl, ttl)
+else
+	save(KEYS[1], ent)
+end
+return {0, ent['Value'], version(ent)}
+`
+
+// persistScript 去除过期时间
+const persistScript = luaLib + `
+local ent = load(KEYS[1])
+if not ent then
+	return 0
+end
+persist(KEYS[1], KEYS[2], ent)
+return 1
+`
+
+// pauseScript 暂停定时并记录剩余时间, ARGV[2]为当前时间
+const pauseScript = luaLib + `
+local ent = load(KEYS[1])
+if not ent then
+	return 0
+end
+if ent['Paused'] or ent['Deadline'] == 0 then
+	return 1
+end
+local deadline = ent['Deadline']
+if (ent['Lease'] or '') ~= '' then
+	deadline = ent['Due']
+end
+unlink(KEYS[1], KEYS[2], ent)
+release(ent)
+ent['Remaining'] = math.max(deadline - tonumber(ARGV[2]), 0)
+ent['Deadline'] = 0
+ent['Paused'] = true
+save(KEYS[1], ent)
+return 1
+`
+
+// resumeScript 按剩余时间恢复定时, ARGV[2]为当前时间
+const resumeScript = luaLib + `
+local ent = load(KEYS[1])
+if not ent then
+	return 0
+end
+if not ent['Paused'] then
+	return 1
+end
+ent['Deadline'] = tonumber(ARGV[2]) + ent['Remaining']
+ent['Paused'] = false
+ent['Remaining'] = 0
+link(KEYS[1], KEYS[2], ARGV[1], ent)
+save(KEYS[1], ent)
+return 1
+`
+
+// txnScript 事务, KEYS[1]为sorted set, KEYS[i+1]为第i个key
+// ARGV[2]为json: {"Conds": [[key序号, 版本号]...], "Ops": [[操作类型, key序号, value, 过期时间, ttl]...]}
+// 前置条件不满足时返回0且不执行任何操作
+const txnScript = luaLib + `
+local txn = cjson.decode(ARGV[2])
+for _, cond in ipairs(txn['Conds']) do
+	if version(load(KEYS[cond[1]])) ~= cond[2] then
+		return 0
+	end
+end
+for _, op in ipairs(txn['Ops']) do
+	exec(KEYS[op[2]], KEYS[1], ARGV[1], op[1], op[3], op[4], op[5])
+end
+return 1
+`
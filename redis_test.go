@@ -2,6 +2,7 @@ package timerstore
 
 import (
 	"fmt"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -50,24 +51,29 @@ func TestRedisProvider(t *testing.T) {
 	equal(true, ok)
 	equal("this is a test", string(valStr))
 
-	due, has, err := r.Before(time.Now().Unix())
+	due, err := r.Claim(time.Now(), 10, time.Minute)
 	if err != nil {
 		t.Fatalf("expected: %v, got: %v", nil, err)
 	}
 
-	fmt.Printf("has: %v, due: %v\n", has, due)
+	fmt.Printf("len: %d, due: %v\n", len(due), due)
 
 	fmt.Printf("===>> sleep starting\n")
 	time.Sleep(time.Duration(5) * time.Second)
 
 	fmt.Printf("===>> sleep over\n")
 
-	due, has, err = r.Before(time.Now().Unix())
+	due, err = r.Claim(time.Now(), 10, time.Minute)
 	if err != nil {
 		t.Fatalf("expected: %v, got: %v", nil, err)
 	}
 
-	fmt.Printf("has: %v, due: %v\n", has, due)
+	fmt.Printf("len: %d, due: %v\n", len(due), due)
+	for _, ev := range due {
+		if _, err := r.Ack(ev.ID, nil); err != nil {
+			t.Fatalf("expected: %v, got: %v", nil, err)
+		}
+	}
 }
 
 func registerRedisProvider(t *testing.T) Provider {
@@ -219,18 +225,23 @@ func benchmarkRedisStore(n int, b *testing.B) {
 	}
 }
 
-func TestBefore(t *testing.T) {
+func TestClaim(t *testing.T) {
 	r := registerRedisProvider(t)
 	r.SetPrefix("Test")
 
 	st := time.Now()
 
-	due, has, err := r.Before(time.Now().Unix())
+	due, err := r.Claim(time.Now(), 100, time.Minute)
 	if err != nil {
 		t.Fatalf("%v", err.Error())
 	}
-	if has == false {
-		t.Fatalf("%v", has)
+	if len(due) == 0 {
+		t.Fatalf("%v", len(due))
+	}
+	for _, ev := range due {
+		if _, err := r.Ack(ev.ID, nil); err != nil {
+			t.Fatalf("%v", err.Error())
+		}
 	}
 
 	cost := time.Since(st)
@@ -238,3 +249,411 @@ func TestBefore(t *testing.T) {
 	fmt.Printf("cost time: %v, len: %d, due: %v\n", cost.String(), len(due), due)
 
 }
+
+// newTestRedisProvider 连接测试用的redis, prefix加上随机后缀, 避免读到之前测试留下的数据
+func newTestRedisProvider(t *testing.T, prefix string) *redisProvider {
+	config := &Config{
+		Host:        "",
+		Port:        "",
+		Password:    "",
+		Type:        "cluster",
+		PoolSize:    10,
+		PoolTimeout: 10,
+	}
+
+	r, err := NewRedisProvider(config)
+	if err != nil {
+		t.Fatalf("expected: %v, got: %v", nil, err)
+	}
+	r.SetPrefix(prefix + strconv.FormatInt(time.Now().UnixNano(), 36))
+
+	return r
+}
+
+func TestRedisMigrate(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	r := newTestRedisProvider(t, "Migrate")
+
+	// 按旧结构写入: prefix:key, prefix:过期时间(unix秒), 以秒为score的sorted set
+	due := time.Now().Add(time.Hour).Unix()
+	timerKey := fmt.Sprintf("%s:%d", r.prefix, due)
+	storeKeys := fmt.Sprintf(`["%s:first","%s:second"]`, r.prefix, r.prefix)
+	equal(nil, DaClient.Set(r.prefix+":first", `{"TimerKey":"`+timerKey+`","Value":"this is the first"}`, 0).Err())
+	equal(nil, DaClient.Set(r.prefix+":second", `{"TimerKey":"`+timerKey+`","Value":"this is the second"}`, 0).Err())
+	equal(nil, DaClient.Set(timerKey, storeKeys, 0).Err())
+	equal(nil, DaClient.ZAdd(r.prefix+":"+sortedSetKey, NewZ(due, timerKey)).Err())
+
+	// 升级后已写入新结构的key不被覆盖
+	equal(nil, r.SetWithTTL("second", "this is the new second", time.Minute))
+
+	n, err := r.Migrate()
+	equal(nil, err)
+	equal(1, n)
+
+	val, ok, _ := r.Get("first")
+	equal(true, ok)
+	equal("this is the first", val)
+	deadline, _, _ := r.Deadline("first")
+	equal(due, deadline.Unix())
+	val, _, _ = r.Get("second")
+	equal("this is the new second", val)
+
+	// 旧数据已删除, 重复执行不再迁移
+	equal(nilMsg, DaClient.Get(r.prefix+":first").Err().Error())
+	equal(nilMsg, DaClient.Get(timerKey).Err().Error())
+	n, err = r.Migrate()
+	equal(nil, err)
+	equal(0, n)
+}
+
+func TestRedisSet(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	r := newTestRedisProvider(t, "Set")
+
+	// entry, 定时与sorted set都在{prefix}下
+	equal(nil, r.SetWithTTL("first", "this is the first", time.Minute))
+	equal(nil, DaClient.Get(r.tag()+":key:first").Err())
+	timers, err := DaClient.ZRange(r.tag()+":"+sortedSetKey, 0, -1).Result()
+	equal(nil, err)
+	equal(1, len(timers))
+
+	ok, err := r.SetNX("first", "this is the first replacement", time.Hour)
+	equal(nil, err)
+	equal(false, ok)
+	ok, err = r.SetXX("second", "this is the second", time.Hour)
+	equal(nil, err)
+	equal(false, ok)
+	_, ok, _ = r.Get("second")
+	equal(false, ok)
+	ok, err = r.SetXX("first", "this is the first replacement", time.Hour)
+	equal(nil, err)
+	equal(true, ok)
+	val, _, _ := r.Get("first")
+	equal("this is the first replacement", val)
+
+	// 旧版本号写入失败, 删除后重新写入也不会得到用过的版本号
+	_, version, ok, _, err := r.Touch("first", false)
+	equal(nil, err)
+	equal(true, ok)
+	ok, err = r.CompareAndSet("first", "cas", time.Hour, version+1)
+	equal(nil, err)
+	equal(false, ok)
+	ok, err = r.CompareAndSet("first", "cas", time.Hour, version)
+	equal(nil, err)
+	equal(true, ok)
+	equal(nil, r.Del("first"))
+	equal(nil, r.SetWithTTL("first", "again", time.Hour))
+	_, again, _, _, _ := r.Touch("first", false)
+	equal(true, again > version+1)
+	ok, _ = r.CompareAndSet("first", "stale", time.Hour, version)
+	equal(false, ok)
+
+	// 覆盖写入后旧的定时被清除
+	timers, _ = DaClient.ZRange(r.tag()+":"+sortedSetKey, 0, -1).Result()
+	equal(1, len(timers))
+}
+
+func TestRedisTake(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	r := newTestRedisProvider(t, "Take")
+
+	now := time.Now()
+	equal(nil, r.SetAt("first", "this is the first", now))
+	val, ok, err := r.Take("first")
+	equal(nil, err)
+	equal(true, ok)
+	equal("this is the first", val)
+	_, ok, _ = r.Take("first")
+	equal(false, ok)
+	evs, _ := r.Claim(now.Add(time.Second), 10, time.Minute)
+	equal(0, len(evs))
+
+	// 回调执行中的key不能被取出
+	equal(nil, r.SetAt("second", "this is the second", now))
+	evs, _ = r.Claim(now.Add(time.Second), 10, time.Minute)
+	equal(1, len(evs))
+	_, ok, _ = r.Take("second")
+	equal(false, ok)
+	ok, _ = r.Ack(evs[0].ID, nil)
+	equal(true, ok)
+	_, ok, _ = r.Get("second")
+	equal(false, ok)
+}
+
+func TestRedisClaim(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	r := newTestRedisProvider(t, "Claim")
+
+	now := time.Now().Truncate(time.Millisecond)
+	equal(nil, r.SetAt("k", "v", now))
+
+	evs, err := r.Claim(now, 10, time.Minute)
+	equal(nil, err)
+	equal(1, len(evs))
+	ev := evs[0]
+	equal("k", ev.Key)
+	equal("v", ev.Value)
+	equal(1, ev.Attempt)
+	d, _, _ := r.Deadline("k")
+	equal(true, d.Equal(now))
+
+	// 租约期间不会被再次租用, 未确认时租约过期后重新到期
+	evs, _ = r.Claim(now, 10, time.Minute)
+	equal(0, len(evs))
+	evs, _ = r.Claim(now.Add(2*time.Minute), 10, time.Minute)
+	equal(1, len(evs))
+	equal(2, evs[0].Attempt)
+	equal(true, evs[0].Deadline.Equal(now))
+
+	// 过期的租约不能再确认
+	ok, err := r.Ack(ev.ID, nil)
+	equal(nil, err)
+	equal(false, ok)
+
+	ok, _ = r.Nack(evs[0].ID, now.Add(time.Second))
+	equal(true, ok)
+	ok, _ = r.Nack(evs[0].ID, now.Add(time.Second))
+	equal(false, ok)
+	d, _, _ = r.Deadline("k")
+	equal(true, d.Equal(now.Add(time.Second)))
+
+	evs, _ = r.Claim(now.Add(time.Second), 10, time.Minute)
+	equal(3, evs[0].Attempt)
+	ok, _ = r.Ack(evs[0].ID, nil)
+	equal(true, ok)
+	_, ok, _ = r.Get("k")
+	equal(false, ok)
+
+	// 确认时对key执行的操作与确认是原子的
+	equal(nil, r.SetAt("k", "v", now))
+	evs, _ = r.Claim(now, 10, time.Minute)
+	ok, _ = r.Ack(evs[0].ID, []TxnOp{{Type: TxnSet, Value: "x", TTL: time.Hour}})
+	equal(true, ok)
+	val, _, _ := r.Get("k")
+	equal("x", val)
+
+	// 租约期间修改过期时间的key不受确认影响
+	equal(nil, r.SetAt("k", "v", now))
+	evs, _ = r.Claim(now, 10, time.Minute)
+	ok, _ = r.Expire("k", time.Hour)
+	equal(true, ok)
+	ok, _ = r.Ack(evs[0].ID, nil)
+	equal(false, ok)
+	_, ok, _ = r.Get("k")
+	equal(true, ok)
+
+	// 回调执行中的计数窗口已结束, 计数写入新的窗口
+	equal(nil, r.SetAt("hits", "5", now))
+	evs, _ = r.Claim(now, 10, time.Minute)
+	n, created, err := r.IncrBy("hits", 1, time.Hour)
+	equal(nil, err)
+	equal(true, created)
+	equal(int64(1), n)
+	ok, _ = r.Ack(evs[0].ID, nil)
+	equal(false, ok)
+	d, _, _ = r.Deadline("hits")
+	equal(true, d.After(now.Add(59*time.Minute)))
+
+	// 回调执行中暂停的key恢复后立即到期
+	equal(nil, r.SetAt("paused", "v", now))
+	evs, _ = r.Claim(now, 10, time.Minute)
+	ok, _ = r.Pause("paused")
+	equal(true, ok)
+	ok, _ = r.Ack(evs[0].ID, nil)
+	equal(false, ok)
+	r.Resume("paused")
+	d, _, _ = r.Deadline("paused")
+	equal(true, d.Before(time.Now().Add(time.Second)))
+	equal(nil, r.Del("paused"))
+
+	// 周期key确认后按规则重新定时
+	first, err := r.SetRecurring("rec", "tick", "@every 1m")
+	equal(nil, err)
+	evs, _ = r.Claim(first, 10, time.Minute)
+	equal(1, len(evs))
+	equal("@every 1m", evs[0].Spec)
+	ok, _ = r.Ack(evs[0].ID, nil)
+	equal(true, ok)
+	d, _, _ = r.Deadline("rec")
+	equal(true, d.After(first))
+}
+
+func TestRedisTouch(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	r := newTestRedisProvider(t, "Touch")
+
+	// 滑动过期的key每次读取按原始ttl重新定时
+	equal(nil, r.SetSliding("session", "token", time.Minute))
+	before, _, _ := r.Deadline("session")
+	time.Sleep(10 * time.Millisecond)
+	val, _, ok, exhausted, err := r.Touch("session", false)
+	equal(nil, err)
+	equal(true, ok)
+	equal(false, exhausted)
+	equal("token", val)
+	after, _, _ := r.Deadline("session")
+	equal(true, after.After(before))
+
+	// 读取次数用完时删除key
+	equal(nil, r.SetMaxReads("once", "code", time.Minute, 2))
+	_, _, ok, exhausted, _ = r.Touch("once", false)
+	equal(true, ok)
+	equal(false, exhausted)
+	results := r.GetMany([]string{"once", "once", "missing"}, false)
+	equal(true, results[0].OK)
+	equal(true, results[0].Exhausted)
+	equal("code", results[0].Value)
+	equal(false, results[1].OK)
+	equal(false, results[2].OK)
+	_, ok, _ = r.Get("once")
+	equal(false, ok)
+}
+
+func TestRedisTxn(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	r := newTestRedisProvider(t, "Txn")
+
+	equal(nil, r.SetWithTTL("hold", "alice", time.Minute))
+	_, version, _, _, _ := r.Touch("hold", false)
+
+	// 前置条件不满足时不执行任何操作
+	ok, err := r.Commit([]TxnCond{{Key: "hold", Version: version + 1}},
+		[]TxnOp{{Type: TxnSet, Key: "seat", Value: "booked", TTL: time.Hour}, {Type: TxnDel, Key: "hold"}})
+	equal(nil, err)
+	equal(false, ok)
+	_, ok, _ = r.Get("seat")
+	equal(false, ok)
+
+	ok, err = r.Commit([]TxnCond{{Key: "hold", Version: version}, {Key: "seat", Version: 0}},
+		[]TxnOp{{Type: TxnSet, Key: "seat", Value: "booked", TTL: time.Hour}, {Type: TxnDel, Key: "hold"}})
+	equal(nil, err)
+	equal(true, ok)
+	val, _, _ := r.Get("seat")
+	equal("booked", val)
+	_, ok, _ = r.Get("hold")
+	equal(false, ok)
+
+	ok, _ = r.Commit(nil, []TxnOp{{Type: TxnPersist, Key: "seat"}})
+	equal(true, ok)
+	d, _, _ := r.Deadline("seat")
+	equal(true, d.IsZero())
+	ok, _ = r.Commit(nil, []TxnOp{{Type: TxnExpire, Key: "seat", TTL: time.Minute}})
+	equal(true, ok)
+	d, _, _ = r.Deadline("seat")
+	equal(false, d.IsZero())
+}
+
+func TestRedisIncrBy(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	r := newTestRedisProvider(t, "Incr")
+
+	n, created, err := r.IncrBy("hits", 2, time.Minute)
+	equal(nil, err)
+	equal(true, created)
+	equal(int64(2), n)
+	deadline, _, _ := r.Deadline("hits")
+
+	// 已存在的key保留原过期时间
+	n, created, err = r.IncrBy("hits", -5, time.Hour)
+	equal(nil, err)
+	equal(false, created)
+	equal(int64(-3), n)
+	d, _, _ := r.Deadline("hits")
+	equal(true, d.Equal(deadline))
+
+	equal(nil, r.SetWithTTL("name", "alice", time.Minute))
+	_, _, err = r.IncrBy("name", 1, time.Minute)
+	equal(errNotInteger, err)
+}
+
+func TestRedisDeadLetter(t *testing.T) {
+
+	equal := func(expected, got interface{}) {
+		if got != expected {
+			t.Fatalf("expeted: %v, got: %v", expected, got)
+		}
+	}
+
+	r := newTestRedisProvider(t, "Dead")
+
+	letters, err := r.DeadLetters()
+	equal(nil, err)
+	equal(0, len(letters))
+
+	now := time.Now().Truncate(time.Millisecond)
+	equal(nil, r.AddDeadLetter(DeadLetter{Key: "b", Value: "2", Deadline: now, FailedAt: now, Attempts: 3, Err: "boom"}))
+	equal(nil, r.AddDeadLetter(DeadLetter{Key: "a", Value: "1", Attempts: 1, Err: "failed", Spec: "@every 1h"}))
+	letters, _ = r.DeadLetters()
+	equal(2, len(letters))
+	equal("a", letters[0].Key)
+	equal("b", letters[1].Key)
+	equal(3, letters[1].Attempts)
+	equal(true, letters[1].Deadline.Equal(now))
+
+	// 同名key存在时不重放
+	equal(nil, r.SetWithTTL("b", "new", time.Hour))
+	ok, err := r.ReplayDeadLetter("b", now.Add(time.Minute))
+	equal(nil, err)
+	equal(false, ok)
+	equal(nil, r.Del("b"))
+	ok, _ = r.ReplayDeadLetter("b", now.Add(time.Minute))
+	equal(true, ok)
+	val, _, _ := r.Get("b")
+	equal("2", val)
+
+	// 周期key重放后保留定时规则
+	ok, _ = r.ReplayDeadLetter("a", now)
+	equal(true, ok)
+	evs, _ := r.Claim(now, 10, time.Minute)
+	equal(1, len(evs))
+	equal("@every 1h", evs[0].Spec)
+
+	n, err := r.PurgeDeadLetters(nil)
+	equal(nil, err)
+	equal(0, n)
+	equal(nil, r.AddDeadLetter(DeadLetter{Key: "c", Value: "3"}))
+	n, _ = r.PurgeDeadLetters([]string{"c", "missing"})
+	equal(1, n)
+}
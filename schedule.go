@@ -0,0 +1,215 @@
+package timerstore
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule 周期定时的规则, 由ParseSchedule解析得到
+type Schedule interface {
+	// Next 返回t之后的下一次触发时间, 没有下一次时返回零值
+	Next(t time.Time) time.Time
+}
+
+// cron描述符对应的表达式
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseSchedule 解析周期定时规则, 支持以下格式:
+// 1. 5个字段的cron表达式: 分 时 日 月 周, 字段支持 * , - / , 周日为0或7
+// 2. @hourly, @daily, @weekly, @monthly, @yearly等描述符
+// 3. @every 时长, 如 @every 90s, 以上一次的触发时间为基准, 不随执行时间漂移
+// cron表达式和描述符可加 TZ=时区 前缀指定IANA时区, 如 TZ=Asia/Shanghai 0 9 * * *, 默认为本地时区
+func ParseSchedule(spec string) (Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, invalidSpec(spec)
+	}
+
+	loc := time.Local
+	if tz := fields[0]; strings.HasPrefix(tz, "TZ=") || strings.HasPrefix(tz, "CRON_TZ=") {
+		l, err := time.LoadLocation(tz[strings.Index(tz, "=")+1:])
+		if err != nil {
+			return nil, invalidSpec(spec)
+		}
+		loc = l
+		fields = fields[1:]
+	}
+
+	if len(fields) == 2 && fields[0] == "@every" {
+		d, err := time.ParseDuration(fields[1])
+		if err != nil || d <= 0 {
+			return nil, invalidSpec(spec)
+		}
+		return every(d), nil
+	}
+	if len(fields) == 1 {
+		if expr, ok := descriptors[fields[0]]; ok {
+			fields = strings.Fields(expr)
+		}
+	}
+	if len(fields) != 5 {
+		return nil, invalidSpec(spec)
+	}
+
+	c := &cron{loc: loc}
+	bounds := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		bits, ok := parseField(fields[i], b.min, b.max)
+		if !ok {
+			return nil, invalidSpec(spec)
+		}
+		*b.bits = bits
+	}
+	// 周日可写为0或7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*" || fields[2] == "?"
+	c.dowAny = fields[4] == "*" || fields[4] == "?"
+
+	return c, nil
+}
+
+// every 固定间隔的周期定时
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// cron 按位记录每个字段允许的取值
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool // 日, 周字段是否为*, 两者都有限制时满足其一即可
+	loc                           *time.Location
+}
+
+// cronHorizon Next最多向后查找的年数, 超过时认为没有下一次触发时间(如2月30日)
+const cronHorizon = 5
+
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + cronHorizon
+
+	for t.Year() <= limit {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = forward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc))
+			continue
+		}
+		if !c.matchDay(t) {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc))
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc))
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// forward 返回next, next不晚于t时返回t之后一分钟, 保证查找总是向后推进
+// 夏令时切换的间隙中time.Date可能返回t之前的时间
+func forward(t time.Time, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Add(time.Minute)
+}
+
+func (c *cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parseField 解析cron的一个字段, 返回允许取值的位图
+func parseField(field string, min, max int) (uint64, bool) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, false
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			i := strings.Index(part, "-")
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(part[:i])
+			hi, err2 = strconv.Atoi(part[i+1:])
+			if err1 != nil || err2 != nil {
+				return 0, false
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, false
+			}
+			lo = n
+			// 单个值带步长时表示从该值到最大值
+			if step == 1 {
+				hi = n
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, false
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, true
+}
+
+// nextFire 计算周期key在deadline触发后的下一次触发时间(unix毫秒)
+// 错过的多次触发只执行一次, 返回0表示没有下一次
+func nextFire(spec string, deadline int64, now time.Time) (int64, error) {
+	sched, err := ParseSchedule(spec)
+	if err != nil {
+		return 0, err
+	}
+	next := sched.Next(fromUnixMilli(deadline))
+	if !next.IsZero() && !next.After(now) {
+		next = sched.Next(now)
+	}
+	if next.IsZero() {
+		return 0, nil
+	}
+	return unixMilli(next), nil
+}
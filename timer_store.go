@@ -1,7 +1,8 @@
 package timerstore
 
 import (
-	"fmt"
+	"context"
+	"sync"
 	"time"
 )
 
@@ -22,71 +23,834 @@ func NewProvider(name string) Provider {
 	return nil
 }
 
+// Item 批量写入时的一项
+type Item struct {
+	Key   string
+	Value string
+	TTL   time.Duration
+}
+
+// GetResult 批量读取时的一项, OK表示key是否存在
+type GetResult struct {
+	Value     string
+	OK        bool
+	Exhausted bool // 本次读取用完了读取次数, key已被删除
+	Err       error
+}
+
 // Handler 业务调用时设置的回调函数
 type Handler func(key string, value string)
 
+// Reason 回调触发的原因
+type Reason int
+
+const (
+	// ReasonExpired 到达过期时间
+	ReasonExpired Reason = iota
+	// ReasonReadsExhausted 读取次数用完
+	ReasonReadsExhausted
+)
+
+// ReasonHandler 带触发原因的回调函数, 通过WithReasonHandler设置
+type ReasonHandler func(key string, value string, reason Reason)
+
 // Set 供业务调用
 // ttl 是存储有效时间, 单位为秒
 func (t *TimerStore) Set(key string, value string, ttl int64) error {
-	return t.store.Set(key, value, ttl)
+	return t.SetWithTTL(key, value, time.Duration(ttl)*time.Second)
+}
+
+// SetWithTTL 同Set, ttl精确到毫秒
+func (t *TimerStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	if t.isClosed() {
+		return errClosed
+	}
+	if err := t.store.SetWithTTL(key, value, ttl); err != nil {
+		return err
+	}
+	t.notify(t.clock.Now().Add(ttl))
+	return nil
+}
+
+// SetDeadline 同SetAt
+func (t *TimerStore) SetDeadline(key string, value string, at time.Time) error {
+	return t.SetAt(key, value, at)
+}
+
+// SetAt 同Set, 在deadline时刻过期, 精确到毫秒
+// 存储的过期时间即为deadline, 不受调用耗时影响
+func (t *TimerStore) SetAt(key string, value string, deadline time.Time) error {
+	if t.isClosed() {
+		return errClosed
+	}
+	if err := t.store.SetAt(key, value, deadline); err != nil {
+		return err
+	}
+	t.notify(deadline)
+	return nil
+}
+
+// SetNX 仅当key不存在时写入, ok表示是否写入
+func (t *TimerStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	if t.isClosed() {
+		return false, errClosed
+	}
+	ok, err := t.store.SetNX(key, value, ttl)
+	if err != nil || !ok {
+		return ok, err
+	}
+	t.notify(t.clock.Now().Add(ttl))
+	return true, nil
+}
+
+// SetSliding 同SetWithTTL, 但每次Get都会按ttl重新定时, 适用于session等按最近访问过期的数据
+func (t *TimerStore) SetSliding(key string, value string, ttl time.Duration) error {
+	if t.isClosed() {
+		return errClosed
+	}
+	if err := t.store.SetSliding(key, value, ttl); err != nil {
+		return err
+	}
+	t.notify(t.clock.Now().Add(ttl))
+	return nil
+}
+
+// SetMaxReads 同SetWithTTL, 但最多只能通过Get读取reads次, 先用完读取次数或先到期都会删除key并执行回调
+// 读取次数用完时回调的原因为ReasonReadsExhausted, reads不大于0时不限制读取次数
+func (t *TimerStore) SetMaxReads(key string, value string, ttl time.Duration, reads int) error {
+	if t.isClosed() {
+		return errClosed
+	}
+	if reads < 0 {
+		reads = 0
+	}
+	if err := t.store.SetMaxReads(key, value, ttl, int64(reads)); err != nil {
+		return err
+	}
+	t.notify(t.clock.Now().Add(ttl))
+	return nil
+}
+
+// SetRecurring 写入周期定时的key, 每次到期执行回调后按spec计算下一次触发时间并重新定时, 直到被删除
+// spec格式见ParseSchedule, 如 "@every 10m", "TZ=Asia/Shanghai 0 9 * * 1-5"
+// 定时规则保存在Provider中, 到期时key先以租约过期时间重新定时, 回调成功后再按规则计算下一次触发时间
+// 回调执行中进程退出时, key在租约过期后重新触发, 不会丢失后续触发
+func (t *TimerStore) SetRecurring(key string, value string, spec string) error {
+	if t.isClosed() {
+		return errClosed
+	}
+	first, err := t.store.SetRecurring(key, value, spec)
+	if err != nil {
+		return err
+	}
+	t.notify(first)
+	return nil
+}
+
+// SetXX 仅当key已存在时写入, ok表示是否写入
+func (t *TimerStore) SetXX(key string, value string, ttl time.Duration) (bool, error) {
+	if t.isClosed() {
+		return false, errClosed
+	}
+	ok, err := t.store.SetXX(key, value, ttl)
+	if err != nil || !ok {
+		return ok, err
+	}
+	t.notify(t.clock.Now().Add(ttl))
+	return true, nil
+}
+
+// Expire 将key的过期时间修改为ttl之后, 不修改value, ok表示key是否存在
+func (t *TimerStore) Expire(key string, ttl time.Duration) (bool, error) {
+	if t.isClosed() {
+		return false, errClosed
+	}
+	ok, err := t.store.Expire(key, ttl)
+	if err != nil || !ok {
+		return ok, err
+	}
+	t.notify(t.clock.Now().Add(ttl))
+	return true, nil
+}
+
+// Persist 去除key的过期时间, value仍可通过Get读取, ok表示key是否存在
+// 之后可通过Expire/ExpireAt重新设置过期时间
+func (t *TimerStore) Persist(key string) (bool, error) {
+	if t.isClosed() {
+		return false, errClosed
+	}
+	return t.store.Persist(key)
+}
+
+// Pause 暂停key的定时并记录剩余时间, 暂停期间不会到期, ok表示key是否存在
+// 到期回调正在执行的key剩余时间为0, 恢复后重新触发
+// 没有过期时间或已暂停的key不做处理
+func (t *TimerStore) Pause(key string) (bool, error) {
+	if t.isClosed() {
+		return false, errClosed
+	}
+	return t.store.Pause(key)
+}
+
+// Resume 恢复被Pause的key, 按暂停时记录的剩余时间重新定时, ok表示key是否存在
+func (t *TimerStore) Resume(key string) (bool, error) {
+	if t.isClosed() {
+		return false, errClosed
+	}
+	ok, err := t.store.Resume(key)
+	if err != nil || !ok {
+		return ok, err
+	}
+	if deadline, has, err := t.store.Deadline(key); err == nil && has && !deadline.IsZero() {
+		t.notify(deadline)
+	}
+	return true, nil
+}
+
+// ExpireAt 将key的过期时间修改为deadline, 不修改value, ok表示key是否存在
+func (t *TimerStore) ExpireAt(key string, deadline time.Time) (bool, error) {
+	if t.isClosed() {
+		return false, errClosed
+	}
+	ok, err := t.store.ExpireAt(key, deadline)
+	if err != nil || !ok {
+		return ok, err
+	}
+	t.notify(deadline)
+	return true, nil
 }
 
 // Get 返回key值对应的value, ok表示是否获取成功
+// 滑动过期的key(SetSliding写入或启用了WithSliding)会按最近一次定时的时长重新定时
+// SetMaxReads写入的key每次读取扣减一次读取次数, 最后一次读取仍返回value, 随后删除key并在后台执行回调
 func (t *TimerStore) Get(key string) (string, bool, error) {
-	return t.store.Get(key)
+	if t.isClosed() {
+		return "", false, errClosed
+	}
+	val, _, ok, err := t.touch(key)
+	return val, ok, err
+}
+
+// touch 读取key并按Get的规则重新定时和扣减读取次数, 读取次数用完时在后台执行回调
+func (t *TimerStore) touch(key string) (string, uint64, bool, error) {
+	val, version, ok, exhausted, err := t.store.Touch(key, t.sliding)
+	if err != nil || !ok {
+		return "", 0, ok, err
+	}
+	if exhausted {
+		t.dispatch(Event{Key: key, Value: val, Reason: ReasonReadsExhausted})
+	}
+	return val, version, true, nil
+}
+
+// Persistent TTL对没有过期时间的key返回的值
+const Persistent time.Duration = -1
+
+// SetMany 批量写入, 返回每一项的写入结果
+func (t *TimerStore) SetMany(items []Item) []error {
+	if t.isClosed() {
+		return fillErrors(len(items), errClosed)
+	}
+
+	errs := t.store.SetMany(items)
+
+	// 只需按最早的过期时间唤醒一次
+	first, has := time.Duration(0), false
+	for i, item := range items {
+		if errs[i] == nil && (!has || item.TTL < first) {
+			first, has = item.TTL, true
+		}
+	}
+	if has {
+		t.notify(t.clock.Now().Add(first))
+	}
+	return errs
+}
+
+// GetMany 批量读取, 返回每一个key的读取结果, 与Get相同地重新定时和扣减读取次数
+func (t *TimerStore) GetMany(keys []string) []GetResult {
+	if t.isClosed() {
+		return fillResults(make([]GetResult, len(keys)), errClosed)
+	}
+	results := t.store.GetMany(keys, t.sliding)
+	for i, res := range results {
+		if res.Exhausted {
+			t.dispatch(Event{Key: keys[i], Value: res.Value, Reason: ReasonReadsExhausted})
+		}
+	}
+	return results
+}
+
+// DelMany 批量删除, 返回每一个key的删除结果
+func (t *TimerStore) DelMany(keys []string) []error {
+	if t.isClosed() {
+		return fillErrors(len(keys), errClosed)
+	}
+	return t.store.DelMany(keys)
+}
+
+// IncrBy 将key的value按整数原子地加上delta, 返回相加后的值
+// key不存在时以delta为初始值写入, 并在ttlIfNew之后过期; key已存在时过期时间不变
+// 到期回调正在执行的key视为窗口已结束, 同样以delta开始新的窗口
+// value不是整数时返回value is not an integer错误
+func (t *TimerStore) IncrBy(key string, delta int64, ttlIfNew time.Duration) (int64, error) {
+	if t.isClosed() {
+		return 0, errClosed
+	}
+	n, created, err := t.store.IncrBy(key, delta, ttlIfNew)
+	if err != nil {
+		return 0, err
+	}
+	if created {
+		t.notify(t.clock.Now().Add(ttlIfNew))
+	}
+	return n, nil
+}
+
+// Take 原子地取出key的value并删除key, 被取出的key不会再执行到期回调
+// 回调正在执行的key已被消费, 返回ok为false
+func (t *TimerStore) Take(key string) (string, bool, error) {
+	if t.isClosed() {
+		return "", false, errClosed
+	}
+	return t.store.Take(key)
+}
+
+// GetWithVersion 同Get, 同时返回value的版本号, 供CompareAndSet使用
+// 与Get相同地重新定时和扣减读取次数, 读取次数用完时返回的版本号已不存在
+func (t *TimerStore) GetWithVersion(key string) (string, uint64, bool, error) {
+	if t.isClosed() {
+		return "", 0, false, errClosed
+	}
+	return t.touch(key)
+}
+
+// CompareAndSet 仅当key当前的版本号等于version时写入, 否则返回version mismatch错误
+// key不存在时版本号为0, 版本号在同一个store内单调递增, key被删除后重新写入也不会得到用过的版本号
+func (t *TimerStore) CompareAndSet(key string, value string, ttl time.Duration, version uint64) error {
+	if t.isClosed() {
+		return errClosed
+	}
+	ok, err := t.store.CompareAndSet(key, value, ttl, version)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errVersionMismatch
+	}
+	t.notify(t.clock.Now().Add(ttl))
+	return nil
+}
+
+// TTL 返回key的剩余有效时间, ok表示key是否存在
+// 已到期但尚未触发回调的key返回0, 没有过期时间或暂停中的key返回Persistent
+func (t *TimerStore) TTL(key string) (time.Duration, bool, error) {
+	deadline, ok, err := t.Deadline(key)
+	if err != nil || !ok {
+		return 0, ok, err
+	}
+	if deadline.IsZero() {
+		return Persistent, true, nil
+	}
+
+	ttl := deadline.Sub(t.clock.Now())
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, true, nil
+}
+
+// Deadline 返回key的过期时间, ok表示key是否存在, 没有过期时间的key返回零值
+// 回调执行期间返回原计划的触发时间
+func (t *TimerStore) Deadline(key string) (time.Time, bool, error) {
+	if t.isClosed() {
+		return time.Time{}, false, errClosed
+	}
+	return t.store.Deadline(key)
 }
 
 // TimerStore 定义一个定时器
 type TimerStore struct {
-	prefix   string        // timer的key值前缀
-	store    Provider      // 定时器存储
-	interval time.Duration // 循环遍历的时间间隔
-	h        Handler       // 定时到期时的回调函数
+	prefix      string        // timer的key值前缀
+	store       Provider      // 定时器存储
+	interval    time.Duration // 无到期key时的最长等待间隔
+	onEvent     EventHandler  // 定时到期时的回调函数
+	logger      Logger        // 日志输出
+	clock       Clock         // 判断到期使用的时钟
+	onError     ErrorHandler  // 出错时的回调
+	concurrency int           // 同时执行回调的最大数量
+	passive     bool          // 是否由调用方调用Run驱动
+	catchUp     CatchUp       // 恢复处理时对暂停期间到期key的策略
+	sliding     bool          // Get时是否对所有key重新定时
+	onAction    ActionHandler // 设置后代替onEvent执行到期回调, 并执行其返回的动作
+	retryPolicy RetryPolicy   // 回调返回error时的重试策略
+	visibility  time.Duration // 租约时长, 回调未在此时间内完成时key重新到期
+	deadLetter  bool          // 重试用完时是否保存死信
+
+	mutex     sync.RWMutex
+	quit      chan struct{}  // Close时关闭, 通知Run退出
+	closed    bool           // 是否已关闭
+	active    bool           // Run是否正在执行
+	suspended bool           // 是否暂停了到期处理
+	held      []Event        // 暂停期间读取次数用完的回调, 恢复时按catchUp处理
+	running   sync.WaitGroup // 正在执行中的遍历及回调
+	target    time.Time      // Run当前等待到的时间点
+	wake      chan struct{}  // 有更早的key写入时唤醒Run
 }
 
-// NewTimerStore 构造一个定时器
+// New 构造一个定时器, 默认在后台goroutine中开始遍历
 // prefix 存储前缀
 // provider 存储类型, 内存, mysql, redis
-func NewTimerStore(prefix, provider string, interval time.Duration, handler Handler) (*TimerStore, error) {
+// opts 可选配置, 见WithInterval等
+func New(prefix, provider string, handler Handler, opts ...Option) (*TimerStore, error) {
 	p, ok := providerMgr[provider]
 	if !ok {
 		return nil, errUnkownProvider
 	}
 
 	t := &TimerStore{
-		prefix:   prefix,
-		store:    p,
-		interval: interval,
-		h:        handler,
+		prefix:      prefix,
+		store:       p,
+		interval:    defaultInterval,
+		visibility:  defaultVisibility,
+		logger:      stdLogger{},
+		clock:       sysClock{},
+		concurrency: 1,
+		quit:        make(chan struct{}),
+		wake:        make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.onEvent == nil {
+		t.onEvent = handler.EventHandler()
+	}
+	if t.onError == nil {
+		t.onError = func(err error) {
+			t.logger.Printf("%s", err.Error())
+		}
+	}
+	if t.concurrency < 1 {
+		t.concurrency = 1
 	}
 	t.store.SetPrefix(prefix)
+	t.store.SetClock(t.clock)
 
-	go t.process()
+	if !t.passive {
+		go t.Run(context.Background())
+	}
 
 	return t, nil
 }
 
-func (t *TimerStore) process() {
-	time.AfterFunc(t.interval, func() {
-		due, ok, err := t.store.Before(time.Now().Unix())
+// NewTimerStore 构造一个定时器, 并在后台goroutine中开始遍历
+// 等同于 New(prefix, provider, handler, WithInterval(interval))
+func NewTimerStore(prefix, provider string, interval time.Duration, handler Handler) (*TimerStore, error) {
+	return New(prefix, provider, handler, WithInterval(interval))
+}
+
+// NewPassiveTimerStore 构造一个不自动遍历的定时器, 由调用方调用Run驱动
+// 等同于 New(prefix, provider, handler, WithInterval(interval), WithPassive())
+func NewPassiveTimerStore(prefix, provider string, interval time.Duration, handler Handler) (*TimerStore, error) {
+	return New(prefix, provider, handler, WithInterval(interval), WithPassive())
+}
+
+// Run 在当前goroutine中循环遍历到期的key并执行回调, 阻塞直到ctx取消或store关闭
+// 返回ctx.Err()或store closed错误, 同一时间只能有一个Run在执行
+func (t *TimerStore) Run(ctx context.Context) error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return errClosed
+	}
+	if t.active {
+		t.mutex.Unlock()
+		return errRunning
+	}
+	t.active = true
+	t.mutex.Unlock()
+
+	defer func() {
+		t.mutex.Lock()
+		t.active = false
+		t.mutex.Unlock()
+	}()
+
+	timer := time.NewTimer(t.nextWait())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.quit:
+			return errClosed
+		case <-t.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+			if err := t.process(ctx); err != nil {
+				// 租用失败时已到期的key仍在, 等待interval后再重试, 避免连续失败时空转
+				timer.Reset(t.waitFor(t.clock.Now(), t.interval))
+				continue
+			}
+		}
+
+		timer.Reset(t.nextWait())
+	}
+}
+
+// nextWait 计算距离最早到期key的等待时间, 最长不超过interval
+func (t *TimerStore) nextWait() time.Duration {
+	wait := t.interval
+	now := t.clock.Now()
+	if t.isSuspended() {
+		// 暂停处理期间不需要关心到期时间, 由ResumeProcessing唤醒
+		return t.waitFor(now, wait)
+	}
+
+	next, ok, err := t.store.Next()
+	if err != nil {
+		t.onError(err)
+	}
+	if ok {
+		if d := next.Sub(now); d < wait {
+			wait = d
+		}
+		if wait < 0 {
+			wait = 0
+		}
+	}
+
+	return t.waitFor(now, wait)
+}
+
+// waitFor 记录Run等待到的时间点, 返回wait
+func (t *TimerStore) waitFor(now time.Time, wait time.Duration) time.Duration {
+	t.mutex.Lock()
+	t.target = now.Add(wait)
+	t.mutex.Unlock()
+
+	return wait
+}
+
+// PauseProcessing 暂停到期处理, Run继续执行但不再遍历到期key和执行回调
+// 已在执行中的回调不受影响, 暂停期间key的定时不变
+// 读取次数用完的回调同样暂缓到恢复时执行, 暂停期间Close时这些回调被丢弃
+func (t *TimerStore) PauseProcessing() {
+	t.mutex.Lock()
+	t.suspended = true
+	t.mutex.Unlock()
+}
+
+// ResumeProcessing 恢复到期处理, 暂停期间到期的key和读取次数用完的回调按WithCatchUp设置的策略处理
+func (t *TimerStore) ResumeProcessing() error {
+	if !t.isSuspended() {
+		return nil
+	}
+
+	if t.catchUp == CatchUpDiscard {
+		// 不执行回调, 一次性key被删除, 周期key跳过本次触发
+		now := t.clock.Now()
+		for {
+			claimed, err := t.store.Claim(now, claimBatch, t.visibility)
+			if err != nil {
+				return err
+			}
+			for _, ev := range claimed {
+				if _, err := t.store.Ack(ev.ID, nil); err != nil {
+					return err
+				}
+			}
+			if len(claimed) < claimBatch {
+				break
+			}
+		}
+	}
+
+	t.mutex.Lock()
+	t.suspended = false
+	held := t.held
+	t.held = nil
+	t.mutex.Unlock()
+
+	if t.catchUp == CatchUpFire {
+		for _, ev := range held {
+			t.dispatch(ev)
+		}
+	}
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (t *TimerStore) isSuspended() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.suspended
+}
+
+// notify 当deadline早于Run当前的等待时间点时, 提前唤醒Run
+func (t *TimerStore) notify(deadline time.Time) {
+	t.mutex.RLock()
+	sooner := deadline.Before(t.target)
+	t.mutex.RUnlock()
+	if !sooner {
+		return
+	}
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close 停止定时器的遍历, 并等待正在执行的回调结束, 等待时间受ctx约束
+// 关闭后再调用Set/Get会返回store closed错误
+func (t *TimerStore) Close(ctx context.Context) error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return errClosed
+	}
+	t.closed = true
+	close(t.quit)
+	t.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *TimerStore) isClosed() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.closed
+}
+
+// process 租用并执行到期key的回调, 直到没有到期key, 租用失败时返回error
+func (t *TimerStore) process(ctx context.Context) error {
+	t.mutex.Lock()
+	if t.closed || t.suspended {
+		t.mutex.Unlock()
+		return nil
+	}
+	t.running.Add(1)
+	t.mutex.Unlock()
+	defer t.running.Done()
+
+	// 每次只租用能同时执行的个数, 避免租约在排队时过期, ctx取消后不再租用新的key
+	now := t.clock.Now()
+	for ctx.Err() == nil && !t.isClosed() && !t.isSuspended() {
+		claimed, err := t.store.Claim(now, t.concurrency, t.visibility)
 		if err != nil {
-			fmt.Printf("%s\n", err.Error())
+			t.onError(err)
+			return err
+		}
+
+		var wg sync.WaitGroup
+		for _, ev := range claimed {
+			wg.Add(1)
+			go func(ev Event) {
+				defer wg.Done()
+				t.handle(ctx, ev)
+			}(ev)
+		}
+		wg.Wait()
+
+		if len(claimed) < t.concurrency {
+			return nil
+		}
+	}
+	return nil
+}
+
+// handle 执行租用到的key的回调, 成功后Ack, 失败时按重试策略Nack或保存死信后Ack
+// 回调执行期间进程退出时, key在租约过期后重新到期
+func (t *TimerStore) handle(ctx context.Context, ev Event) {
+	if t.onAction != nil {
+		// 动作随Ack一起执行, 租约失效时key已被修改, 动作不生效
+		ops := t.onAction(ev.Key, ev.Value).ops(ev)
+		ok, err := t.store.Ack(ev.ID, ops)
+		if ok {
+			t.notifyOps(ops)
 		}
+		t.report(err)
+		return
+	}
+
+	ev.Reason = ReasonExpired
+	cause := t.fire(ctx, ev)
+	if cause == nil {
+		_, err := t.store.Ack(ev.ID, nil)
+		t.report(err)
+		return
+	}
+	t.onError(cause)
+
+	if ev.Attempt < t.retryPolicy.MaxAttempts {
+		deadline := t.clock.Now().Add(t.retryPolicy.backoff(ev.Attempt))
+		ok, err := t.store.Nack(ev.ID, deadline)
 		if ok {
-			for key, val := range due {
-				t.h(key, val)
-				t.store.Del(key)
-			}
+			t.notify(deadline)
 		}
-		t.process()
-	})
+		t.report(err)
+		return
+	}
+	if err := t.bury(ev, cause); err != nil {
+		// 死信未保存时不Ack, 租约过期后重新执行
+		t.onError(err)
+		return
+	}
+	_, err := t.store.Ack(ev.ID, nil)
+	t.report(err)
+}
+
+// report 将非nil的error交给onError
+func (t *TimerStore) report(err error) {
+	if err != nil {
+		t.onError(err)
+	}
+}
+
+// dispatch 在后台执行回调, Close会等待其结束, 已关闭时在当前goroutine执行
+// 暂停处理期间回调被暂存, 由ResumeProcessing处理
+func (t *TimerStore) dispatch(ev Event) {
+	t.mutex.Lock()
+	if t.suspended && !t.closed {
+		t.held = append(t.held, ev)
+		t.mutex.Unlock()
+		return
+	}
+	if t.closed {
+		t.mutex.Unlock()
+		if err := t.fire(context.Background(), ev); err != nil {
+			t.onError(err)
+		}
+		return
+	}
+	t.running.Add(1)
+	t.mutex.Unlock()
+
+	go func() {
+		defer t.running.Done()
+		if err := t.fire(context.Background(), ev); err != nil {
+			t.onError(err)
+		}
+	}()
+}
+
+// fire 补全Event后执行回调
+func (t *TimerStore) fire(ctx context.Context, ev Event) error {
+	ev.Store = t.prefix
+	ev.FiredAt = t.clock.Now()
+	if ev.Attempt == 0 {
+		ev.Attempt = 1
+	}
+	return t.onEvent(ctx, ev)
 }
 
 // Provider 定义存储层的接口, 实现可以是内存, redis, mysql等
 type Provider interface {
 	SetPrefix(prefix string)
+	// SetClock 设置计算过期时间使用的时钟, 由TimerStore在构造时以WithClock设置的时钟调用
+	SetClock(clock Clock)
 	Get(key string) (string, bool, error)
+	// Deadline 返回过期时间, 回调执行期间返回原计划的触发时间
+	Deadline(key string) (time.Time, bool, error)
 	Set(key string, val string, ttl int64) error
+	SetWithTTL(key string, val string, ttl time.Duration) error
+	SetAt(key string, val string, deadline time.Time) error
+	SetSliding(key string, val string, ttl time.Duration) error
+	SetMaxReads(key string, val string, ttl time.Duration, reads int64) error
+	// SetRecurring 写入周期定时的key, 返回第一次触发时间
+	SetRecurring(key string, val string, spec string) (time.Time, error)
+	SetNX(key string, val string, ttl time.Duration) (bool, error)
+	SetXX(key string, val string, ttl time.Duration) (bool, error)
+	CompareAndSet(key string, val string, ttl time.Duration, version uint64) (bool, error)
+	Expire(key string, ttl time.Duration) (bool, error)
+	ExpireAt(key string, deadline time.Time) (bool, error)
+	Persist(key string) (bool, error)
+	Pause(key string) (bool, error)
+	Resume(key string) (bool, error)
+	// Del 删除key, 回调执行中的key同样删除, 之后的Ack不再重新定时
 	Del(key string) error
-	Before(t int64) (map[string]string, bool, error)
+	// Take 取出value并删除key, 回调执行中(租约未过期)的key视为已被取走, 返回false
+	Take(key string) (string, bool, error)
+	// Claim 租用最多limit个在now之前到期的key, 租用的key在visibility之后重新到期, 直到Ack
+	// 返回的Event包含ID, Key, Value, 原计划的Deadline和租用次数Attempt
+	Claim(now time.Time, limit int, visibility time.Duration) ([]Event, error)
+	// Ack 确认租约并对key原子地执行ops, ops的Key被忽略; ops为空时一次性key删除, 周期key按规则重新定时
+	// 租约已过期被重新租用或key在回调期间被写入, 修改过期时间等时不执行ops, 返回false
+	Ack(id string, ops []TxnOp) (bool, error)
+	// Nack 放弃租约, key在deadline重新到期, 租约已失效时返回false
+	Nack(id string, deadline time.Time) (bool, error)
+	// AddDeadLetter 保存死信, 同一个key覆盖之前的死信
+	AddDeadLetter(dl DeadLetter) error
+	// DeadLetters 列出所有死信, 按key排序
+	DeadLetters() ([]DeadLetter, error)
+	// ReplayDeadLetter 将死信重新写入为在deadline到期的key并移除死信, 周期key保留定时规则
+	// 死信不存在或key已存在时返回false
+	ReplayDeadLetter(key string, deadline time.Time) (bool, error)
+	// PurgeDeadLetters 删除指定的死信, keys为空时删除全部, 返回删除的个数
+	PurgeDeadLetters(keys []string) (int, error)
+	// Touch 读取value和版本号, 当always为true或key以滑动过期写入时, 按最近一次定时的时长重新定时
+	// 有读取次数限制的key扣减一次, 用完时删除key并返回exhausted为true
+	Touch(key string, always bool) (val string, version uint64, ok bool, exhausted bool, err error)
+	IncrBy(key string, delta int64, ttlIfNew time.Duration) (int64, bool, error)
+	// GetMany 批量读取, 每个key按Touch的规则重新定时和扣减读取次数
+	GetMany(keys []string, always bool) []GetResult
+	SetMany(items []Item) []error
+	DelMany(keys []string) []error
+	Commit(conds []TxnCond, ops []TxnOp) (bool, error)
+	Next() (time.Time, bool, error)
+}
+
+// unixMilli 返回t的unix毫秒时间戳, 存储层统一使用毫秒精度
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func fillErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+func fillResults(results []GetResult, err error) []GetResult {
+	for i := range results {
+		results[i].Err = err
+	}
+	return results
+}
+
+// remaining 返回deadline(unix毫秒)距离now的剩余毫秒数, 已到期返回0
+func remaining(deadline int64, now time.Time) int64 {
+	left := deadline - unixMilli(now)
+	if left < 0 {
+		left = 0
+	}
+	return left
 }
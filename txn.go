@@ -0,0 +1,108 @@
+package timerstore
+
+import (
+	"time"
+)
+
+// TxnOpType 事务中操作的类型
+type TxnOpType int
+
+const (
+	// TxnSet 写入value并定时
+	TxnSet TxnOpType = iota
+	// TxnDel 删除key
+	TxnDel
+	// TxnExpire 修改过期时间, key不存在时不做处理
+	TxnExpire
+	// TxnPersist 去除过期时间, key不存在时不做处理
+	TxnPersist
+)
+
+// TxnOp 事务中的一个操作
+type TxnOp struct {
+	Type  TxnOpType
+	Key   string
+	Value string
+	TTL   time.Duration
+}
+
+// TxnCond 事务的前置条件, 要求key当前的版本号等于Version, 版本号0表示key不存在
+type TxnCond struct {
+	Key     string
+	Version uint64
+}
+
+// Txn 同一个store内多个key的事务, 由TimerStore.Txn创建
+// Commit时先检查所有前置条件, 全部满足后按顺序执行所有操作, 否则不执行任何操作
+type Txn struct {
+	t     *TimerStore
+	conds []TxnCond
+	ops   []TxnOp
+}
+
+// Txn 创建一个事务
+func (t *TimerStore) Txn() *Txn {
+	return &Txn{
+		t:     t,
+		conds: []TxnCond{},
+		ops:   []TxnOp{},
+	}
+}
+
+// IfVersion 增加前置条件, 要求key当前的版本号等于version
+func (x *Txn) IfVersion(key string, version uint64) *Txn {
+	x.conds = append(x.conds, TxnCond{Key: key, Version: version})
+	return x
+}
+
+// Set 增加写入操作
+func (x *Txn) Set(key string, value string, ttl time.Duration) *Txn {
+	x.ops = append(x.ops, TxnOp{Type: TxnSet, Key: key, Value: value, TTL: ttl})
+	return x
+}
+
+// Del 增加删除操作
+func (x *Txn) Del(key string) *Txn {
+	x.ops = append(x.ops, TxnOp{Type: TxnDel, Key: key})
+	return x
+}
+
+// Expire 增加修改过期时间操作
+func (x *Txn) Expire(key string, ttl time.Duration) *Txn {
+	x.ops = append(x.ops, TxnOp{Type: TxnExpire, Key: key, TTL: ttl})
+	return x
+}
+
+// Persist 增加去除过期时间操作
+func (x *Txn) Persist(key string) *Txn {
+	x.ops = append(x.ops, TxnOp{Type: TxnPersist, Key: key})
+	return x
+}
+
+// Commit 提交事务, 前置条件不满足时返回version mismatch错误
+func (x *Txn) Commit() error {
+	if x.t.isClosed() {
+		return errClosed
+	}
+
+	ok, err := x.t.store.Commit(x.conds, x.ops)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errVersionMismatch
+	}
+
+	x.t.notifyOps(x.ops)
+	return nil
+}
+
+// notifyOps 按事务中写入和修改过期时间的操作唤醒Run
+func (t *TimerStore) notifyOps(ops []TxnOp) {
+	now := t.clock.Now()
+	for _, op := range ops {
+		if op.Type == TxnSet || op.Type == TxnExpire {
+			t.notify(now.Add(op.TTL))
+		}
+	}
+}